@@ -0,0 +1,170 @@
+package main
+
+import (
+    "os"
+    "fmt"
+    "flag"
+    "net"
+    "bufio"
+    "time"
+    "syscall"
+    "encoding/json"
+
+    "github.com/lucas8/notifier/lib/config"
+    "github.com/lucas8/notifier/lib/fifo"
+    "github.com/lucas8/notifier/lib/socket"
+)
+
+var expire  = flag.Int("t", 5000, "the time in milliseconds the notification stays on the screen")
+var level   = flag.String("u", "normal", "the level of the notification")
+var icon    = flag.String("i", "", "accepted for compatibility with notify-send, icons are not supported")
+var app     = flag.String("a", "", "the name of the application, which the rules can match")
+var group   = flag.String("g", "", "the group of the notification, the application by default")
+var replace = flag.Uint("r", 0, "the id of the notification to replace")
+var closeId = flag.Uint("close", 0, "close the notification with this id instead of opening one")
+var wait    = flag.Bool("wait", false, "wait until the notification is closed or clicked")
+var timeout = flag.Duration("timeout", 5 * time.Second, "how long to wait for the daemon")
+
+type command struct {
+    Cmd     string  `json:"cmd"`
+    Level   string  `json:"level,omitempty"`
+    App     string  `json:"app,omitempty"`
+    Group   string  `json:"group,omitempty"`
+    Timeout uint32  `json:"timeout,omitempty"`
+    Summary string  `json:"summary,omitempty"`
+    Body    string  `json:"body,omitempty"`
+    Id      *uint32 `json:"id,omitempty"`
+    Replace uint32  `json:"replace,omitempty"`
+    Wait    bool    `json:"wait,omitempty"`
+}
+
+func usage() {
+    fmt.Fprintf(os.Stderr, "Usage : %v [options] summary [body]\n", os.Args[0])
+    flag.PrintDefaults()
+}
+
+func fail(format string, args ...interface{}) {
+    fmt.Fprintf(os.Stderr, format + "\n", args...)
+    os.Exit(1)
+}
+
+func buildCommand() command {
+    if *closeId != 0 {
+        id := uint32(*closeId)
+        return command{Cmd: "close", Id: &id}
+    }
+
+    args := flag.Args()
+    if len(args) < 1 || len(args) > 2 {
+        usage()
+        os.Exit(2)
+    }
+    cmd := command{Cmd: "notif", Level: *level, App: *app, Group: *group, Summary: args[0]}
+    if len(args) == 2 {
+        cmd.Body = args[1]
+    }
+    /* The daemon counts in seconds */
+    cmd.Timeout = uint32((*expire + 999) / 1000)
+    cmd.Replace = uint32(*replace)
+    cmd.Wait = *wait
+    return cmd
+}
+
+/* Send the command on the socket and print the answers */
+func sendSocket(path string, cmd command) {
+    conn, err := net.DialTimeout("unix", path, *timeout)
+    if err != nil {
+        fail("Can't reach the daemon on %v : %v", path, err)
+    }
+    defer conn.Close()
+
+    data, _ := json.Marshal(cmd)
+    conn.SetDeadline(time.Now().Add(*timeout))
+    if _, err := conn.Write(append(data, '\n')); err != nil {
+        fail("Can't send the command : %v", err)
+    }
+
+    rd := bufio.NewReader(conn)
+    resp := readResponse(rd)
+    if resp.Id != nil {
+        fmt.Println(*resp.Id)
+    }
+    if cmd.Wait {
+        /* No deadline when waiting for the notification to be closed */
+        conn.SetDeadline(time.Time{})
+        if resp := readResponse(rd); resp.Clicked {
+            fmt.Printf("clicked %v\n", resp.Button)
+        }
+    }
+}
+
+func readResponse(rd *bufio.Reader) fifo.JSONResponse {
+    var resp fifo.JSONResponse
+    line, err := rd.ReadString('\n')
+    if err != nil {
+        fail("No answer from the daemon : %v", err)
+    }
+    if err := json.Unmarshal([]byte(line), &resp); err != nil {
+        fail("Invalid answer from the daemon : %v", err)
+    }
+    if !resp.Ok {
+        fail("Error from the daemon : %v", resp.Error)
+    }
+    return resp
+}
+
+/* Write the command in the fifo. There is no answer, so no id. */
+func sendFifo(path string, cmd command) {
+    if cmd.Wait || cmd.Replace != 0 {
+        fail("The daemon only listens on its fifo, -wait and -r need the socket")
+    }
+
+    /* Fails with ENXIO instead of blocking when no daemon reads the fifo */
+    file, err := os.OpenFile(path, os.O_WRONLY | syscall.O_NONBLOCK, 0)
+    if err != nil {
+        if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.ENXIO {
+            fail("The daemon is not running (no reader on %v)", path)
+        }
+        fail("Can't open the fifo : %v", err)
+    }
+    defer file.Close()
+
+    data, _ := json.Marshal(cmd)
+    file.SetWriteDeadline(time.Now().Add(*timeout))
+    if _, err := file.Write(append(data, '\n')); err != nil {
+        fail("Can't send the command : %v", err)
+    }
+}
+
+/* Whether path is a socket, which a daemon may listen on */
+func isSocket(path string) bool {
+    stat, err := os.Stat(path)
+    return err == nil && stat.Mode() & os.ModeSocket != 0
+}
+
+func main() {
+    flag.Usage = usage
+    path := config.ConfigPath()
+    cfg, err := config.Load(path)
+    if err != nil {
+        fail("Error when loading config : %v", err)
+    }
+
+    cmd := buildCommand()
+    if *icon != "" {
+        fmt.Fprintf(os.Stderr, "Icons are not supported, ignoring %v\n", *icon)
+    }
+
+    /* The socket is preferred whenever the daemon may listen on it and it
+     * exists, as only it answers. A socket left by a crash is ignored when the
+     * config only enables the fifo. */
+    transport := "both"
+    if tr, err := cfg.String("global.transport"); err == nil {
+        transport = tr
+    }
+    if transport == "socket" || (transport != "fifo" && isSocket(socket.Path(cfg))) {
+        sendSocket(socket.Path(cfg), cmd)
+    } else {
+        sendFifo(fifo.Path(cfg), cmd)
+    }
+}
@@ -4,9 +4,11 @@ import (
     "fmt"
     "os"
     "flag"
+    "sort"
     "strings"
     "strconv"
     "bufio"
+    "path/filepath"
     "io"
 )
 
@@ -33,10 +35,18 @@ func ConfigPath() (path string) {
 type config struct {
     name string
     value string
+    /* Whether a value has been given to this entry, and where */
+    set bool
+    file string
+    line, col int
     child *config
     next *config
 }
-var root *config
+
+/* A loaded config, made of the entries of a file and of its includes */
+type Tree struct {
+    root *config
+}
 
 func parseKey(key string) []string {
     return strings.Split(key, ".")
@@ -54,7 +64,7 @@ func findOnLevel(name string, lvl *config) *config {
 }
 
 func followTree(path []string, rt *config, create bool) *config {
-    if len(path) == 0 {
+    if len(path) == 0 || rt == nil {
         return rt
     }
 
@@ -64,7 +74,7 @@ func followTree(path []string, rt *config, create bool) *config {
     } else if !create {
         return nil
     } else {
-        cfg := config{path[0], "", nil, nil}
+        cfg := config{name: path[0]}
         if rt.child == nil {
             rt.child = &cfg
         } else {
@@ -75,71 +85,291 @@ func followTree(path []string, rt *config, create bool) *config {
     }
 }
 
-type InvalidLineError string
+type InvalidLineError struct {
+    file string
+    line, col int
+    msg string
+}
 func (e InvalidLineError) Error() string {
-    return fmt.Sprintf("Ill-formed config line : \"%s\"", string(e))
+    return fmt.Sprintf("%v:%v:%v: %v", e.file, e.line, e.col, e.msg)
 }
 
-func parseLine(line string) error {
-    var fields []string = strings.Fields(line)
-    if len(fields) == 0 {
-        return nil
-    } else if len(fields) < 3 || fields[1] != ":" {
-        return InvalidLineError(line)
+/* Several errors reported at once */
+type ErrorList []error
+func (e ErrorList) Error() string {
+    msgs := make([]string, len(e))
+    for i, err := range e {
+        msgs[i] = err.Error()
     }
+    return strings.Join(msgs, "\n")
+}
 
-    var tree []string = parseKey(fields[0])
-    cfg := followTree(tree, root, true)
-    cfg.value = strings.Join(fields[2:], " ")
-    return nil
+func isSpace(c byte) bool {
+    return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+/* Skip the spaces of line starting at i */
+func skipSpaces(line string, i int) int {
+    for i < len(line) && isSpace(line[i]) {
+        i++
+    }
+    return i
+}
+
+/* Read a quoted value starting at line[i] == '"'. The only escapes are \" and
+ * \\. Return the value and the index after the closing quote. */
+func parseQuoted(line string, i int) (string, int, bool) {
+    var value []byte
+    for i++; i < len(line); i++ {
+        switch line[i] {
+        case '"':
+            return string(value), i + 1, true
+        case '\\':
+            if i + 1 < len(line) && (line[i+1] == '"' || line[i+1] == '\\') {
+                i++
+            }
+        }
+        value = append(value, line[i])
+    }
+    return "", i, false
+}
+
+func validKey(key string) bool {
+    for _, part := range parseKey(key) {
+        if part == "" {
+            return false
+        }
+        for _, c := range part {
+            if isSpace(byte(c)) || c == '"' {
+                return false
+            }
+        }
+    }
+    return true
+}
+
+/* Expand the ${VAR} and ${VAR:-default} references to environment variables.
+ * Returns the index of the faulty reference on error. */
+func expandEnv(value string) (string, int, bool) {
+    var res []byte
+    for i := 0; i < len(value); i++ {
+        if value[i] != '$' || i + 1 >= len(value) || value[i+1] != '{' {
+            res = append(res, value[i])
+            continue
+        }
+        end := strings.IndexByte(value[i:], '}')
+        if end < 0 {
+            return "", i, false
+        }
+        ref := value[i+2 : i+end]
+        name, def, hasDef := ref, "", false
+        if sep := strings.Index(ref, ":-"); sep >= 0 {
+            name, def, hasDef = ref[:sep], ref[sep+2:], true
+        }
+        if name == "" {
+            return "", i, false
+        }
+        env := os.Getenv(name)
+        if env == "" && hasDef {
+            env = def
+        }
+        res = append(res, env...)
+        i += end
+    }
+    return string(res), 0, true
 }
 
-func clearConfig() {
-    root = nil
+/* Parse a line of the form 'key : value', where value may be quoted. Blank
+ * lines and lines starting with a '#' are ignored, an empty key is then
+ * returned. Columns start at 1. */
+func parseLine(file string, nb int, line string) (key, value string, col int, err error) {
+    perr := func(col int, msg string, args ...interface{}) error {
+        return InvalidLineError{file, nb, col + 1, fmt.Sprintf(msg, args...)}
+    }
+
+    start := skipSpaces(line, 0)
+    if start == len(line) || line[start] == '#' {
+        return "", "", 0, nil
+    }
+
+    sep := strings.IndexByte(line, ':')
+    if sep < 0 {
+        return "", "", 0, perr(start, "expected 'key : value'")
+    }
+    key = strings.TrimSpace(line[start:sep])
+    if key == "" {
+        return "", "", 0, perr(start, "missing key")
+    } else if !validKey(key) {
+        return "", "", 0, perr(start, "invalid key \"%v\"", key)
+    }
+
+    vstart := skipSpaces(line, sep + 1)
+    if vstart == len(line) {
+        return "", "", 0, perr(vstart, "missing value for \"%v\"", key)
+    }
+    if line[vstart] == '"' {
+        var end int
+        var ok bool
+        value, end, ok = parseQuoted(line, vstart)
+        if !ok {
+            return "", "", 0, perr(vstart, "unterminated quoted value")
+        }
+        if end = skipSpaces(line, end); end != len(line) {
+            return "", "", 0, perr(end, "unexpected text after quoted value")
+        }
+    } else {
+        value = strings.Join(strings.Fields(line[vstart:]), " ")
+    }
+
+    value, at, ok := expandEnv(value)
+    if !ok {
+        return "", "", 0, perr(vstart + at, "invalid variable reference")
+    }
+    return key, value, start + 1, nil
 }
 
-func Load(path string) error {
+/* Load the entries of a file in the tree. stack holds the absolute paths of
+ * the files including it, to detect include cycles. */
+func (t *Tree) loadFile(path string, stack []string, errs *ErrorList) error {
     file, err := os.Open(path)
     if err != nil {
         return err
     }
-    file.Seek(0, os.SEEK_SET)
+    defer file.Close()
     buffer := bufio.NewReader(file)
-    root = &config{"root", "", nil, nil}
+    if abs, err := filepath.Abs(path); err == nil {
+        stack = append(stack, abs)
+    }
 
-    for {
+    for nb := 1; ; nb++ {
         line, err := buffer.ReadString('\n')
-        switch err {
-        case io.EOF:
-            return nil
-        case nil:
-            err = parseLine(line)
-            if err != nil {
-                clearConfig()
-                return err
-            }
-        default:
-            clearConfig()
+        if err != nil && err != io.EOF {
             return err
         }
+
+        key, value, col, perr := parseLine(path, nb, line)
+        if perr != nil {
+            *errs = append(*errs, perr)
+        } else if key == "include" {
+            if ierr := t.include(path, value, stack, errs); ierr != nil {
+                *errs = append(*errs, InvalidLineError{path, nb, col, ierr.Error()})
+            }
+        } else if key != "" {
+            cfg := followTree(parseKey(key), t.root, true)
+            cfg.value = value
+            cfg.set   = true
+            cfg.file  = path
+            cfg.line  = nb
+            cfg.col   = col
+        }
+
+        if err == io.EOF {
+            return nil
+        }
     }
 }
 
-func dumpEntry(out io.Writer, lvl int, ent *config) {
-    if ent == nil {
-        return
+/* Load the file included by 'include : target' in the file from */
+func (t *Tree) include(from, target string, stack []string, errs *ErrorList) error {
+    if !filepath.IsAbs(target) {
+        target = filepath.Join(filepath.Dir(from), target)
+    }
+    abs, err := filepath.Abs(target)
+    if err != nil {
+        return err
+    }
+    for _, p := range stack {
+        if p == abs {
+            return fmt.Errorf("include cycle on \"%v\"", target)
+        }
+    }
+    return t.loadFile(target, stack, errs)
+}
+
+/* Load the config file and the files it includes. All the syntax errors are
+ * reported at once as an ErrorList. */
+func Load(path string) (*Tree, error) {
+    t := &Tree{&config{name: "root"}}
+
+    var errs ErrorList
+    if err := t.loadFile(path, nil, &errs); err != nil {
+        return nil, err
+    }
+
+    if len(errs) != 0 {
+        return nil, errs
+    }
+    return t, nil
+}
+
+/* Quote the value if it could not be read back as is */
+func dumpValue(value string) string {
+    if value != "" && value[0] != '"' && !strings.ContainsAny(value, " \t") {
+        return value
+    }
+    value = strings.Replace(value, "\\", "\\\\", -1)
+    value = strings.Replace(value, "\"", "\\\"", -1)
+    return "\"" + value + "\""
+}
+
+func sortedKeys(schema map[string]rule) []string {
+    keys := make([]string, 0, len(schema))
+    for key := range schema {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+/* The value of a global entry, or its default */
+func (t *Tree) globalValue(key string) (string, bool) {
+    if value, err := t.String("global." + key); err == nil {
+        return value, true
     }
-    fmt.Fprintf(out, "%v|-> %v : \"%v\"\n", strings.Repeat("\t", lvl), ent.name, ent.value)
-    dumpEntry(out, lvl + 1, ent.child)
-    dumpEntry(out, lvl, ent.next)
+    def, _, _ := expandEnv(globalSchema[key].def)
+    return def, def != ""
 }
 
-func Dump(out io.Writer) {
-    dumpEntry(out, 0, root)
+/* Write the effective config, with the defaults and inheritance resolved, in a
+ * syntax which can be loaded back */
+func (t *Tree) Dump(out io.Writer) {
+    fmt.Fprintf(out, "# global\n")
+    for _, key := range sortedKeys(globalSchema) {
+        if value, ok := t.globalValue(key); ok {
+            fmt.Fprintf(out, "global.%v : %v\n", key, dumpValue(value))
+        }
+    }
+
+    for _, lvl := range t.Levels() {
+        fmt.Fprintf(out, "\n# %v\n", lvl)
+        for _, key := range sortedKeys(levelSchema) {
+            if key == "inherits" {
+                continue
+            }
+            value, err := t.LevelString(lvl, key)
+            ok := err == nil
+            if !ok {
+                value, ok = t.globalValue(key)
+            }
+            if ok {
+                fmt.Fprintf(out, "%v.%v : %v\n", lvl, key, dumpValue(value))
+            }
+        }
+    }
+
+    for _, name := range t.Rules() {
+        fmt.Fprintf(out, "\n# rule %v\n", name)
+        for _, key := range sortedKeys(ruleSchema) {
+            full := "rules." + name + "." + key
+            if value, err := t.String(full); err == nil {
+                fmt.Fprintf(out, "%v : %v\n", full, dumpValue(value))
+            }
+        }
+    }
 }
 
-func Has(key string) bool {
-    return followTree(parseKey(key), root, false) != nil
+func (t *Tree) Has(key string) bool {
+    return followTree(parseKey(key), t.root, false) != nil
 }
 
 type NoEntryError string
@@ -152,8 +382,8 @@ func (e InvalidEntryError) Error() string {
     return fmt.Sprintf("Entry \"%v\" has invalid format : \"%v\" (%v)", e.key, e.value, e.err)
 }
 
-func String(key string) (string, error) {
-    ent := followTree(parseKey(key), root, false)
+func (t *Tree) String(key string) (string, error) {
+    ent := followTree(parseKey(key), t.root, false)
     if ent == nil {
         return "", NoEntryError(key)
     } else {
@@ -161,8 +391,8 @@ func String(key string) (string, error) {
     }
 }
 
-func Int(key string) (int32, error) {
-    ent := followTree(parseKey(key), root, false)
+func (t *Tree) Int(key string) (int32, error) {
+    ent := followTree(parseKey(key), t.root, false)
     if ent == nil {
         return 0, NoEntryError(key)
     } else {
@@ -174,8 +404,8 @@ func Int(key string) (int32, error) {
     }
 }
 
-func Bool(key string) (bool, error) {
-    ent := followTree(parseKey(key), root, false)
+func (t *Tree) Bool(key string) (bool, error) {
+    ent := followTree(parseKey(key), t.root, false)
     if ent == nil {
         return false, NoEntryError(key)
     } else {
@@ -192,3 +422,63 @@ func Bool(key string) (bool, error) {
     }
 }
 
+type InheritanceCycleError string
+func (e InheritanceCycleError) Error() string {
+    return fmt.Sprintf("Inheritance cycle on level \"%v\"", string(e))
+}
+
+/* The levels whose entries apply to level through the inherits entries, from
+ * level itself to its furthest ancestor */
+func (t *Tree) Ancestors(level string) ([]string, error) {
+    chain := []string{level}
+    for {
+        parent, err := t.String(chain[len(chain) - 1] + ".inherits")
+        if err != nil {
+            return chain, nil
+        }
+        for _, lvl := range chain {
+            if lvl == parent {
+                return nil, InheritanceCycleError(level)
+            }
+        }
+        chain = append(chain, parent)
+    }
+}
+
+/* The full key of the first entry of level or of its ancestors named key */
+func (t *Tree) levelKey(level, key string) (string, error) {
+    chain, err := t.Ancestors(level)
+    if err != nil {
+        return "", err
+    }
+    for _, lvl := range chain {
+        if ent := followTree(parseKey(lvl + "." + key), t.root, false); ent != nil && ent.set {
+            return lvl + "." + key, nil
+        }
+    }
+    return "", NoEntryError(level + "." + key)
+}
+
+func (t *Tree) LevelString(level, key string) (string, error) {
+    k, err := t.levelKey(level, key)
+    if err != nil {
+        return "", err
+    }
+    return t.String(k)
+}
+
+func (t *Tree) LevelInt(level, key string) (int32, error) {
+    k, err := t.levelKey(level, key)
+    if err != nil {
+        return 0, err
+    }
+    return t.Int(k)
+}
+
+func (t *Tree) LevelBool(level, key string) (bool, error) {
+    k, err := t.levelKey(level, key)
+    if err != nil {
+        return false, err
+    }
+    return t.Bool(k)
+}
@@ -0,0 +1,91 @@
+package config
+
+import (
+    "io/ioutil"
+    "path/filepath"
+    "testing"
+)
+
+func loadString(t *testing.T, name, content string) *Tree {
+    path := filepath.Join(t.TempDir(), name)
+    if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+        t.Fatal(err)
+    }
+    tree, err := Load(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return tree
+}
+
+/* Two trees loaded one after the other must not share any entry */
+func TestTreesAreIndependent(t *testing.T) {
+    a := loadString(t, "a", "global.list : normal,urgent\n" +
+                            "global.width : 300\n" +
+                            "normal.gc.fg : #ff0000\n" +
+                            "urgent.inherits : normal\n" +
+                            "urgent.width : 400\n")
+    b := loadString(t, "b", "global.list : low\n" +
+                            "global.width : 200\n" +
+                            "low.gc.fg : #00ff00\n")
+
+    if list, err := a.String("global.list"); err != nil || list != "normal,urgent" {
+        t.Errorf("a: global.list is %q (%v), expected \"normal,urgent\"", list, err)
+    }
+    if list, err := b.String("global.list"); err != nil || list != "low" {
+        t.Errorf("b: global.list is %q (%v), expected \"low\"", list, err)
+    }
+
+    if wd, err := a.Int("global.width"); err != nil || wd != 300 {
+        t.Errorf("a: global.width is %v (%v), expected 300", wd, err)
+    }
+    if wd, err := b.Int("global.width"); err != nil || wd != 200 {
+        t.Errorf("b: global.width is %v (%v), expected 200", wd, err)
+    }
+
+    if fg, err := a.LevelString("urgent", "gc.fg"); err != nil || fg != "#ff0000" {
+        t.Errorf("a: urgent.gc.fg is %q (%v), expected \"#ff0000\"", fg, err)
+    }
+    if wd, err := a.LevelInt("urgent", "width"); err != nil || wd != 400 {
+        t.Errorf("a: urgent.width is %v (%v), expected 400", wd, err)
+    }
+    if fg, err := b.LevelString("low", "gc.fg"); err != nil || fg != "#00ff00" {
+        t.Errorf("b: low.gc.fg is %q (%v), expected \"#00ff00\"", fg, err)
+    }
+
+    /* The levels of one tree are unknown to the other */
+    if _, err := a.LevelString("low", "gc.fg"); err == nil {
+        t.Errorf("a: low.gc.fg is set, it is only in b")
+    }
+    if _, err := b.LevelString("urgent", "gc.fg"); err == nil {
+        t.Errorf("b: urgent.gc.fg is set, it is only in a")
+    }
+    if _, err := b.LevelInt("urgent", "width"); err == nil {
+        t.Errorf("b: urgent.width is set, it is only in a")
+    }
+    if b.Has("normal.gc.fg") {
+        t.Errorf("b has normal.gc.fg, it is only in a")
+    }
+}
+
+/* A rule can only set a level declared in global.list, like inherits */
+func TestValidateRuleLevel(t *testing.T) {
+    base := "global.list : normal,urgent\n" +
+            "global.rules : up\n" +
+            "normal.width : 300\n" +
+            "urgent.width : 400\n" +
+            "rules.up.match.text : fire\n"
+
+    if err := loadString(t, "valid", base + "rules.up.level : urgent\n").Validate(); err != nil {
+        t.Errorf("a rule setting a declared level is rejected : %v", err)
+    }
+
+    err := loadString(t, "invalid", base + "rules.up.level : critical\n").Validate()
+    errs, ok := err.(ErrorList)
+    if !ok || len(errs) != 1 {
+        t.Fatalf("expected one error for the undeclared level, got %v", err)
+    }
+    if verr, ok := errs[0].(ValidationError); !ok || verr.key != "rules.up.level" {
+        t.Errorf("expected an error on rules.up.level, got %v", errs[0])
+    }
+}
@@ -0,0 +1,325 @@
+package config
+
+import (
+    "fmt"
+    "sort"
+    "regexp"
+    "strings"
+    "strconv"
+)
+
+type kind int
+
+const (
+    kindString kind = iota
+    kindInt
+    kindBool
+    kindColor
+    kindList
+    kindEnum
+    kindRegex
+    kindHours
+)
+
+type rule struct {
+    kind kind
+    /* The value used when the entry is not given, empty if there is none. It
+     * must be kept in sync with the packages reading the entry. Environment
+     * variables are expanded as in the values of the config. */
+    def string
+    /* The accepted values of a kindEnum entry */
+    values []string
+}
+
+/* The entries accepted in the global namespace */
+var globalSchema = map[string]rule {
+    "list":              {kindList, "", nil},
+    "rules":             {kindList, "", nil},
+    "width":             {kindInt, "500", nil},
+    "gravity":           {kindEnum, "top_right",
+                          []string{"top_left", "top_right", "bottom_left", "bottom_right"}},
+    "order":             {kindEnum, "oldest_first", []string{"oldest_first", "newest_first"}},
+    "override_redirect": {kindBool, "true", nil},
+    "fifo":              {kindString, "${XDG_RUNTIME_DIR:-/tmp}/xcbnotif.fifo", nil},
+    "fifo_mode":         {kindInt, "0600", nil},
+    "socket":            {kindString, "${XDG_RUNTIME_DIR:-/tmp}/xcbnotif.sock", nil},
+    "socket_mode":       {kindInt, "0600", nil},
+    "transport":         {kindEnum, "both", []string{"fifo", "socket", "both"}},
+    "state":             {kindString, "${XDG_RUNTIME_DIR:-/tmp}/xcbnotif.state", nil},
+    "state_interval":    {kindInt, "30", nil},
+    "coalesce":          {kindInt, "0", nil},
+    "group_size":        {kindInt, "0", nil},
+    "rate.burst":        {kindInt, "20", nil},
+    "rate.refill":       {kindInt, "5", nil},
+    "hooks.timeout":     {kindInt, "10", nil},
+    "hooks.max":         {kindInt, "4", nil},
+    "padding.hori":      {kindInt, "15", nil},
+    "padding.vert":      {kindInt, "15", nil},
+    "padding.space":     {kindInt, "15", nil},
+    "gc.bg":             {kindColor, "#000000", nil},
+    "gc.fg":             {kindColor, "#ffffff", nil},
+    "gc.bc":             {kindColor, "#ffffff", nil},
+    "gc.width":          {kindInt, "5", nil},
+    "gc.radius":         {kindInt, "0", nil},
+    "gc.font":           {kindString, "-*-terminal-medium-r-*-*-14-*-*-*-*-*-iso8859-*", nil},
+}
+
+/* The entries accepted in the namespace of a level. They default to the entry
+ * of the inherited level, then to the global entry of the same name. */
+var levelSchema = map[string]rule {
+    "inherits":    {kindString, "", nil},
+    "width":       {kindInt, "", nil},
+    "gc.bg":       {kindColor, "", nil},
+    "gc.fg":       {kindColor, "", nil},
+    "gc.bc":       {kindColor, "", nil},
+    "gc.width":    {kindInt, "", nil},
+    "gc.radius":   {kindInt, "", nil},
+    "gc.font":     {kindString, "", nil},
+    "rate.burst":  {kindInt, "", nil},
+    "rate.refill": {kindInt, "", nil},
+    "priority":    {kindInt, "", nil},
+    "on_show":     {kindString, "", nil},
+    "on_close":    {kindString, "", nil},
+    "on_click":    {kindString, "", nil},
+}
+
+/* The entries accepted in the namespace of a rule, rules.<name>. The match
+ * entries select the notifications, the other ones change them. */
+var ruleSchema = map[string]rule {
+    "match.level":  {kindString, "", nil},
+    "match.text":   {kindRegex, "", nil},
+    "match.source": {kindString, "", nil},
+    "match.hours":  {kindHours, "", nil},
+    "level":        {kindString, "", nil},
+    "timeout":      {kindInt, "", nil},
+    "suppress":     {kindBool, "", nil},
+    "rewrite":      {kindString, "", nil},
+    "screen":       {kindInt, "", nil},
+    "command":      {kindString, "", nil},
+}
+
+type ValidationError struct {
+    file string
+    line, col int
+    key, msg string
+}
+func (e ValidationError) Error() string {
+    if e.line == 0 {
+        return fmt.Sprintf("\"%v\" : %v", e.key, e.msg)
+    }
+    return fmt.Sprintf("%v:%v:%v: \"%v\" : %v", e.file, e.line, e.col, e.key, e.msg)
+}
+
+func isHex(c byte) bool {
+    return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+/* Accepts the formats G, RGB, RRGGBB and RRGGBBAA, with an optional '#' */
+func validColor(str string) bool {
+    if len(str) != 0 && str[0] == '#' {
+        str = str[1:]
+    }
+    switch len(str) {
+    case 1, 3, 6, 8:
+    default:
+        return false
+    }
+    for i := 0; i < len(str); i++ {
+        if !isHex(str[i]) {
+            return false
+        }
+    }
+    return true
+}
+
+type InvalidHoursError string
+func (e InvalidHoursError) Error() string {
+    return fmt.Sprintf("\"%v\" is not a range of hours like 22:00-07:30", string(e))
+}
+
+func parseClock(str string) (int, bool) {
+    parts := strings.Split(str, ":")
+    if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) != 2 {
+        return 0, false
+    }
+    h, err1 := strconv.Atoi(parts[0])
+    m, err2 := strconv.Atoi(parts[1])
+    if err1 != nil || err2 != nil || h < 0 || h > 23 || m < 0 || m > 59 {
+        return 0, false
+    }
+    return h * 60 + m, true
+}
+
+/* Parse a range of hours of the form HH:MM-HH:MM, returned in minutes since
+ * midnight. The range wraps around midnight when to is before from. */
+func ParseHours(str string) (from, to int, err error) {
+    parts := strings.Split(str, "-")
+    if len(parts) != 2 {
+        return 0, 0, InvalidHoursError(str)
+    }
+    var ok1, ok2 bool
+    from, ok1 = parseClock(strings.TrimSpace(parts[0]))
+    to, ok2 = parseClock(strings.TrimSpace(parts[1]))
+    if !ok1 || !ok2 {
+        return 0, 0, InvalidHoursError(str)
+    }
+    return from, to, nil
+}
+
+func checkValue(r rule, value string) string {
+    switch r.kind {
+    case kindInt:
+        if _, err := strconv.ParseInt(value, 0, 32); err != nil {
+            return "not an integer"
+        }
+    case kindBool:
+        switch value {
+        case "True", "true", "1", "False", "false", "0":
+        default:
+            return "not a boolean"
+        }
+    case kindColor:
+        if !validColor(value) {
+            return "not a color"
+        }
+    case kindList:
+        for _, item := range strings.Split(value, ",") {
+            if item == "" {
+                return "empty item in list"
+            }
+        }
+    case kindEnum:
+        for _, v := range r.values {
+            if v == value {
+                return ""
+            }
+        }
+        return fmt.Sprintf("expected one of %v", strings.Join(r.values, ", "))
+    case kindRegex:
+        if _, err := regexp.Compile(value); err != nil {
+            return err.Error()
+        }
+    case kindHours:
+        if _, _, err := ParseHours(value); err != nil {
+            return "not a range of hours like 22:00-07:30"
+        }
+    }
+    return ""
+}
+
+/* Call fn on each entry which has been given a value, with its full key */
+func walk(prefix string, ent *config, fn func(string, *config)) {
+    for ; ent != nil; ent = ent.next {
+        key := ent.name
+        if prefix != "" {
+            key = prefix + "." + ent.name
+        }
+        if ent.set {
+            fn(key, ent)
+        }
+        walk(key, ent.child, fn)
+    }
+}
+
+/* Levels returns the levels declared in global.list */
+func (t *Tree) Levels() []string {
+    list, err := t.String("global.list")
+    if err != nil {
+        return nil
+    }
+    return strings.Split(list, ",")
+}
+
+/* Rules returns the rules declared in global.rules, in the order they apply */
+func (t *Tree) Rules() []string {
+    list, err := t.String("global.rules")
+    if err != nil {
+        return nil
+    }
+    return strings.Split(list, ",")
+}
+
+/* Check the loaded config against the schema : unknown keys, undeclared or
+ * missing levels, rules setting an undeclared level and ill-formed values are
+ * all reported at once. Returns nil if the config is valid, an ErrorList
+ * otherwise. */
+func (t *Tree) Validate() error {
+    var errs ErrorList
+
+    levels := make(map[string]bool)
+    for _, lvl := range t.Levels() {
+        levels[lvl] = true
+    }
+    rules := make(map[string]bool)
+    for _, name := range t.Rules() {
+        rules[name] = true
+    }
+
+    walk("", t.root.child, func(key string, ent *config) {
+        verr := func(msg string) {
+            errs = append(errs, ValidationError{ent.file, ent.line, ent.col, key, msg})
+        }
+        path := parseKey(key)
+        var r rule
+        var ok bool
+        if path[0] == "global" {
+            r, ok = globalSchema[strings.Join(path[1:], ".")]
+        } else if path[0] == "rules" {
+            if len(path) < 3 {
+                verr("unknown key")
+                return
+            } else if !rules[path[1]] {
+                verr(fmt.Sprintf("rule \"%v\" is not declared in global.rules", path[1]))
+                return
+            }
+            r, ok = ruleSchema[strings.Join(path[2:], ".")]
+        } else if levels[path[0]] {
+            r, ok = levelSchema[strings.Join(path[1:], ".")]
+        } else {
+            verr(fmt.Sprintf("level \"%v\" is not declared in global.list", path[0]))
+            return
+        }
+        if !ok {
+            verr("unknown key")
+            return
+        }
+        if msg := checkValue(r, ent.value); msg != "" {
+            verr(fmt.Sprintf("invalid value \"%v\" (%v)", ent.value, msg))
+        }
+        if path[0] != "rules" && path[1] == "inherits" {
+            if !levels[ent.value] {
+                verr(fmt.Sprintf("inherits from undeclared level \"%v\"", ent.value))
+            } else if _, err := t.Ancestors(path[0]); err != nil {
+                verr(err.Error())
+            }
+        }
+        if path[0] == "rules" && strings.Join(path[2:], ".") == "level" && !levels[ent.value] {
+            verr(fmt.Sprintf("sets the undeclared level \"%v\"", ent.value))
+        }
+    })
+
+    if !t.Has("global.list") {
+        errs = append(errs, ValidationError{"", 0, 0, "global.list", "missing entry"})
+    } else {
+        ent := followTree(parseKey("global.list"), t.root, false)
+        for _, lvl := range t.Levels() {
+            if lvl == "rules" {
+                errs = append(errs, ValidationError{ent.file, ent.line, ent.col, "global.list",
+                                    "\"rules\" is reserved and can't be a level"})
+            } else if lvl != "" && lvl != "global" && findOnLevel(lvl, t.root.child) == nil {
+                errs = append(errs, ValidationError{ent.file, ent.line, ent.col, "global.list",
+                                    fmt.Sprintf("level \"%v\" has no section", lvl)})
+            }
+        }
+    }
+
+    if len(errs) != 0 {
+        /* The tree is stored in reverse order */
+        sort.SliceStable(errs, func(i, j int) bool {
+            ei, ej := errs[i].(ValidationError), errs[j].(ValidationError)
+            return ei.file < ej.file || (ei.file == ej.file && ei.line < ej.line)
+        })
+        return errs
+    }
+    return nil
+}
@@ -1,86 +1,168 @@
 package fifo
 
 import (
+    "fmt"
     "syscall"
     "os"
     "bufio"
+    "sync"
 
     "github.com/lucas8/notifier/lib/config"
+    "github.com/lucas8/notifier/lib/limit"
     "github.com/lucas8/notifier/lib/types"
 )
 
-const defaultPath = "/tmp/xcbnotif.fifo"
+const (
+    defaultName = "xcbnotif.fifo"
+    defaultMode = 0600
+)
+
+type NotFifoError string
+func (e NotFifoError) Error() string {
+    return fmt.Sprintf("\"%v\" exists and is not a fifo", string(e))
+}
+
+/* The path of the fifo : global.fifo, or in $XDG_RUNTIME_DIR by default */
+func Path(cfg *config.Tree) string {
+    if path, err := cfg.String("global.fifo"); err == nil {
+        return path
+    }
+    dir := os.Getenv("XDG_RUNTIME_DIR")
+    if dir == "" {
+        dir = "/tmp"
+    }
+    return dir + "/" + defaultName
+}
 
 type Command interface {
     Validate(string) bool
     Get() types.Order
 }
 
-type fdReader int
-func (fdr fdReader) Read(p []byte) (int, error) {
-    n, e := syscall.Read(int(fdr), p)
-    if n < 0 {
-        n = 0
+/* The commands known by the transports. Validate stores the parsed arguments
+ * in the command, so the parsing is serialized between the transports. */
+type Parser struct {
+    mutex sync.Mutex
+    cmds []Command
+}
+
+func NewParser() *Parser {
+    var p Parser
+    p.cmds = make([]Command, 0, 5)
+    return &p
+}
+
+func (p *Parser) AddCmd(cmd Command) {
+    p.cmds = append(p.cmds, cmd)
+}
+
+/* The order of the first command validating line. The lines starting with a
+ * '{' are commands of the JSON protocol. */
+func (p *Parser) Parse(line string) (types.Order, bool) {
+    if IsJSON(line) {
+        order, _, err := ParseJSON(line)
+        return order, err == nil
+    }
+
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    for _, cmd := range p.cmds {
+        if cmd.Validate(line) {
+            return cmd.Get(), true
+        }
+    }
+    return nil, false
+}
+
+/* Record the transport a notification came from, for the rules */
+func WithSource(order types.Order, source string) types.Order {
+    if notif, ok := order.(types.NotifOrder); ok {
+        notif.Source = source
+        return notif
     }
-    return n, e
+    return order
 }
 
 type Fifo struct {
     path string
-    fd   fdReader
+    file *os.File
+    /* Kept open so that the reads never hit EOF when the clients close the
+     * fifo : they block until a client writes instead */
+    wfile *os.File
     rd   *bufio.Reader
-    cmds []Command
+    parser *Parser
+    limiter *limit.Limiter
 }
 
-func Open() (*Fifo, error) {
+func Open(cfg *config.Tree, parser *Parser, limiter *limit.Limiter) (*Fifo, error) {
     var pipe Fifo
-    pipe.path = defaultPath
-    if config.Has("global.fifo") {
-        pipe.path, _ = config.String("config.fifo")
+    pipe.path = Path(cfg)
+    var mode uint32 = defaultMode
+    if m, err := cfg.Int("global.fifo_mode"); err == nil {
+        mode = uint32(m)
     }
 
-    if _, err := os.Stat(pipe.path); err == nil {
+    /* Only remove a fifo left by a previous run, never another file */
+    if stat, err := os.Lstat(pipe.path); err == nil {
+        if stat.Mode() & os.ModeNamedPipe == 0 {
+            return nil, NotFifoError(pipe.path)
+        }
         err = os.Remove(pipe.path)
         if err != nil {
             return nil, err
         }
     }
 
-    if err := syscall.Mkfifo(pipe.path, 0777); err != nil {
+    if err := syscall.Mkfifo(pipe.path, mode); err != nil {
+        return nil, err
+    }
+    /* The mode given to mkfifo is restricted by the umask */
+    if err := os.Chmod(pipe.path, os.FileMode(mode)); err != nil {
+        os.Remove(pipe.path)
         return nil, err
     }
 
-    fd, err := syscall.Open(pipe.path, syscall.O_RDONLY | syscall.O_NONBLOCK, 0777)
+    /* Opened non blocking, the fifo is handled by the runtime poller : the
+     * reads only block the reading goroutine */
+    file, err := os.OpenFile(pipe.path, os.O_RDONLY | syscall.O_NONBLOCK, 0)
+    if err != nil {
+        os.Remove(pipe.path)
+        return nil, err
+    }
+    wfile, err := os.OpenFile(pipe.path, os.O_WRONLY, 0)
     if err != nil {
+        file.Close()
+        os.Remove(pipe.path)
         return nil, err
     }
 
-    pipe.fd   = fdReader(fd)
-    pipe.rd   = bufio.NewReader(pipe.fd)
-    pipe.cmds = make([]Command, 0, 5)
+    pipe.file   = file
+    pipe.wfile  = wfile
+    pipe.rd     = bufio.NewReader(pipe.file)
+    pipe.parser = parser
+    pipe.limiter = limiter
     return &pipe, nil
 }
 
 func (pipe *Fifo) Close() {
-    syscall.Close(int(pipe.fd))
+    pipe.file.Close()
+    pipe.wfile.Close()
     os.Remove(pipe.path)
 }
 
-func (pipe *Fifo) AddCmd(cmd Command) {
-    pipe.cmds = append(pipe.cmds, cmd)
-}
-
+/* Send the orders written in the fifo to c, until the fifo is closed. A line
+ * written in several parts is kept in the reader until it is complete. */
 func (pipe *Fifo) ReadOrders(c chan<- types.Order) {
     for {
         line, err := pipe.rd.ReadString('\n')
-        if err != nil || len(line) == 0 {
-            continue
+        if err != nil {
+            return
         }
         line = line[:len(line) - 1]
-        for _, cmd := range pipe.cmds {
-            if cmd.Validate(line) {
-                c <- cmd.Get()
-                break
+        if order, ok := pipe.parser.Parse(line); ok {
+            order = WithSource(order, "fifo")
+            if pipe.limiter.Allow(order) {
+                c <- order
             }
         }
     }
@@ -0,0 +1,121 @@
+package fifo
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "syscall"
+    "testing"
+    "time"
+
+    "github.com/lucas8/notifier/lib/config"
+    "github.com/lucas8/notifier/lib/limit"
+    "github.com/lucas8/notifier/lib/types"
+)
+
+/* Accepts any line as the text of a notification */
+type echoCmd struct {
+    text string
+}
+
+func (cmd *echoCmd) Validate(line string) bool {
+    cmd.text = line
+    return true
+}
+
+func (cmd *echoCmd) Get() types.Order {
+    return types.NotifOrder{Level: "normal", Text: cmd.text, Screen: -1}
+}
+
+/* A fifo in a temporary directory, read by ReadOrders until the test ends */
+func openFifo(t *testing.T) (*Fifo, chan types.Order) {
+    dir := t.TempDir()
+    path := filepath.Join(dir, "config")
+    content := "global.list : normal\nglobal.fifo : " + filepath.Join(dir, "fifo") + "\n"
+    if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+        t.Fatal(err)
+    }
+    cfg, err := config.Load(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    orders := make(chan types.Order, 10)
+    parser := NewParser()
+    parser.AddCmd(&echoCmd{})
+    pipe, err := Open(cfg, parser, limit.New(cfg, orders))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    done := make(chan struct{})
+    go func() {
+        pipe.ReadOrders(orders)
+        close(done)
+    }()
+    t.Cleanup(func() {
+        pipe.Close()
+        <-done
+    })
+    return pipe, orders
+}
+
+func cpuTime() time.Duration {
+    var usage syscall.Rusage
+    syscall.Getrusage(syscall.RUSAGE_SELF, &usage)
+    return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+/* Without any writer, the reader must sleep instead of polling the fifo */
+func TestIdleReadDoesNotSpin(t *testing.T) {
+    _, orders := openFifo(t)
+
+    before := cpuTime()
+    select {
+    case o := <-orders:
+        t.Fatalf("received %v without any writer", o)
+    case <-time.After(time.Second):
+    }
+    if used := cpuTime() - before; used > 100 * time.Millisecond {
+        t.Errorf("used %v of CPU in 1s while idle", used)
+    }
+}
+
+/* A line written in two parts is one order, sent once it is complete */
+func TestPartialLine(t *testing.T) {
+    pipe, orders := openFifo(t)
+
+    w, err := os.OpenFile(pipe.path, os.O_WRONLY, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer w.Close()
+
+    if _, err := w.Write([]byte("hello ")); err != nil {
+        t.Fatal(err)
+    }
+    select {
+    case o := <-orders:
+        t.Fatalf("received %v before the end of the line", o)
+    case <-time.After(100 * time.Millisecond):
+    }
+
+    if _, err := w.Write([]byte("world\n")); err != nil {
+        t.Fatal(err)
+    }
+    select {
+    case o := <-orders:
+        ord, ok := o.(types.NotifOrder)
+        if !ok || ord.Text != "hello world" || ord.Source != "fifo" {
+            t.Errorf("received %#v, expected the notification \"hello world\"", o)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("the completed line was not received")
+    }
+
+    select {
+    case o := <-orders:
+        t.Errorf("received the extra order %v", o)
+    case <-time.After(100 * time.Millisecond):
+    }
+}
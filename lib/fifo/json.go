@@ -0,0 +1,107 @@
+package fifo
+
+import (
+    "fmt"
+    "strings"
+    "encoding/json"
+
+    "github.com/lucas8/notifier/lib/types"
+)
+
+/* A command of the JSON protocol, one object per line, eg
+ * {"cmd":"notif","level":"urgent","timeout":5,"summary":"...","body":"..."} */
+type jsonCommand struct {
+    Cmd     string  `json:"cmd"`
+    Level   string  `json:"level"`
+    Timeout uint32  `json:"timeout"`
+    App     string  `json:"app"`
+    Group   string  `json:"group"`
+    Summary string  `json:"summary"`
+    Body    string  `json:"body"`
+    Id      *uint32 `json:"id"`
+    Replace uint32  `json:"replace"`
+    Wait    bool    `json:"wait"`
+}
+
+/* The answer to a JSON command */
+type JSONResponse struct {
+    Ok      bool    `json:"ok"`
+    Id      *uint32 `json:"id,omitempty"`
+    Closed  bool    `json:"closed,omitempty"`
+    /* Whether the notification was clicked, and with which button */
+    Clicked bool    `json:"clicked,omitempty"`
+    Button  byte    `json:"button,omitempty"`
+    Error   string  `json:"error,omitempty"`
+}
+
+type InvalidCommandError string
+func (e InvalidCommandError) Error() string {
+    return fmt.Sprintf("Invalid command : %v", string(e))
+}
+
+/* Whether the line is a command of the JSON protocol */
+func IsJSON(line string) bool {
+    return strings.HasPrefix(strings.TrimLeft(line, " \t"), "{")
+}
+
+/* Decode a command of the JSON protocol in the same orders as the line one.
+ * wait is set if the client asks to be told when the notification closes. */
+func ParseJSON(line string) (order types.Order, wait bool, err error) {
+    var cmd jsonCommand
+    if err := json.Unmarshal([]byte(line), &cmd); err != nil {
+        return nil, false, InvalidCommandError(err.Error())
+    }
+    order, err = cmd.order()
+    return order, cmd.Wait, err
+}
+
+func (cmd *jsonCommand) order() (types.Order, error) {
+    switch cmd.Cmd {
+    case "kill", "end":
+        return types.KillOrder {nil}, nil
+    case "redraw":
+        return types.RedrawOrder {true, 0, types.Geometry{}}, nil
+    case "close":
+        if cmd.Id != nil {
+            return types.CloseOrder {false, false, *cmd.Id}, nil
+        }
+        return types.CloseOrder {false, true, 0}, nil
+    case "close_all":
+        return types.CloseOrder {true, false, 0}, nil
+    case "notif":
+        if cmd.Level == "" {
+            return nil, InvalidCommandError("notif without level")
+        }
+        text := cmd.Summary
+        if cmd.Body != "" {
+            text = strings.TrimSpace(text + " " + cmd.Body)
+        }
+        return types.NotifOrder {Time: cmd.Timeout, Level: cmd.Level, Text: text,
+                                 App: cmd.App, Group: cmd.Group, Screen: -1,
+                                 Replace: cmd.Replace}, nil
+    }
+    return nil, InvalidCommandError(fmt.Sprintf("unknown command \"%v\"", cmd.Cmd))
+}
+
+/* Encode the answer to a JSON command. id is only given for notif. */
+func Response(id *uint32, err error) []byte {
+    resp := JSONResponse{err == nil, id, false, false, 0, ""}
+    if err != nil {
+        resp.Id = nil
+        resp.Error = err.Error()
+    }
+    data, _ := json.Marshal(resp)
+    return append(data, '\n')
+}
+
+/* Encode the message telling a waiting client its notification is closed */
+func ClosedResponse(id uint32) []byte {
+    data, _ := json.Marshal(JSONResponse{true, &id, true, false, 0, ""})
+    return append(data, '\n')
+}
+
+/* Encode the message telling a waiting client its notification is clicked */
+func ClickedResponse(id uint32, button byte) []byte {
+    data, _ := json.Marshal(JSONResponse{true, &id, false, true, button, ""})
+    return append(data, '\n')
+}
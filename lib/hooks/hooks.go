@@ -0,0 +1,96 @@
+package hooks
+
+import (
+    "fmt"
+    "os"
+    "os/exec"
+    "time"
+    "syscall"
+
+    "github.com/lucas8/notifier/lib/config"
+)
+
+const (
+    defaultTimeout = 10
+    defaultMax     = 4
+)
+
+/* The events of a notification running the hooks of its level */
+var events = [...]string{"show", "close", "click"}
+
+/* Runs the commands of the hooks and rules in the background. At most max of
+ * them run at once, the others are dropped, and they are killed after
+ * timeout. */
+type Hooks struct {
+    /* The command of each level and event */
+    cmds map[string]string
+    timeout time.Duration
+    slots chan struct{}
+}
+
+func Load(cfg *config.Tree) *Hooks {
+    var h Hooks
+    h.cmds = make(map[string]string)
+    for _, lvl := range cfg.Levels() {
+        for _, ev := range events {
+            if cmd, err := cfg.LevelString(lvl, "on_" + ev); err == nil && cmd != "" {
+                h.cmds[lvl + "." + ev] = cmd
+            }
+        }
+    }
+
+    h.timeout = defaultTimeout * time.Second
+    if nb, err := cfg.Int("global.hooks.timeout"); err == nil {
+        h.timeout = time.Duration(nb) * time.Second
+    }
+    max := int32(defaultMax)
+    if nb, err := cfg.Int("global.hooks.max"); err == nil && nb > 0 {
+        max = nb
+    }
+    h.slots = make(chan struct{}, max)
+    return &h
+}
+
+/* Run the hook of the level for the event, if there is one. env holds the
+ * fields of the notification, as NAME=value. */
+func (h *Hooks) Run(level, event string, env ...string) {
+    if cmd, ok := h.cmds[level + "." + event]; ok {
+        h.Exec(cmd, append(env, "XCBNOTIF_EVENT=" + event)...)
+    }
+}
+
+/* Run the shell command in the background, with env added to the environment
+ * of the daemon. Never blocks. */
+func (h *Hooks) Exec(command string, env ...string) {
+    select {
+    case h.slots <- struct{}{}:
+    default:
+        fmt.Printf("Too many hooks running, dropping \"%v\"\n", command)
+        return
+    }
+
+    cmd := exec.Command("/bin/sh", "-c", command)
+    cmd.Env = append(os.Environ(), env...)
+    /* In its own process group, to kill the commands started by the shell */
+    cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+    if err := cmd.Start(); err != nil {
+        <-h.slots
+        fmt.Printf("Error while running \"%v\" : %s\n", command, err)
+        return
+    }
+
+    go func() {
+        var timer *time.Timer
+        if h.timeout > 0 {
+            pid := cmd.Process.Pid
+            timer = time.AfterFunc(h.timeout, func() {
+                syscall.Kill(-pid, syscall.SIGKILL)
+            })
+        }
+        cmd.Wait()
+        if timer != nil {
+            timer.Stop()
+        }
+        <-h.slots
+    }()
+}
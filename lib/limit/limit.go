@@ -0,0 +1,168 @@
+package limit
+
+import (
+    "fmt"
+    "sync"
+    "time"
+
+    "github.com/lucas8/notifier/lib/config"
+    "github.com/lucas8/notifier/lib/types"
+)
+
+const (
+    defaultBurst  = 20
+    defaultRefill = 5
+    /* How long the summary of the dropped notifications stays on the screen */
+    summaryTime = 10
+    /* Beyond this number of buckets, the idle ones are forgotten */
+    maxBuckets = 1000
+)
+
+/* A token bucket, for a level and a client */
+type bucket struct {
+    level, client string
+    tokens float64
+    last   time.Time
+    burst, refill float64
+    /* The notifications dropped since the last summary */
+    dropped int
+    /* Whether a summary is scheduled */
+    pending bool
+}
+
+/* Limits the rate of the notifications of each level and client. Their
+ * excess is dropped, and a summary notification tells how many were. */
+type Limiter struct {
+    mutex sync.Mutex
+    cfg *config.Tree
+    buckets map[string]*bucket
+    /* Where the summaries are sent */
+    orders chan<- types.Order
+}
+
+type RateLimitedError struct {}
+func (e RateLimitedError) Error() string {
+    return "too many notifications, dropped"
+}
+
+func New(cfg *config.Tree, orders chan<- types.Order) *Limiter {
+    var l Limiter
+    l.cfg = cfg
+    l.buckets = make(map[string]*bucket)
+    l.orders = orders
+    return &l
+}
+
+/* The client of a notification : its transport, and its application if it
+ * gave one */
+func client(ord types.NotifOrder) string {
+    if ord.App != "" {
+        return ord.Source + "/" + ord.App
+    }
+    return ord.Source
+}
+
+func (l *Limiter) newBucket(level, client string, now time.Time) *bucket {
+    var b bucket
+    b.level = level
+    b.client = client
+    b.last = now
+    b.burst = defaultBurst
+    if nb, err := l.cfg.LevelInt(level, "rate.burst"); err == nil {
+        b.burst = float64(nb)
+    } else if nb, err := l.cfg.Int("global.rate.burst"); err == nil {
+        b.burst = float64(nb)
+    }
+    b.refill = defaultRefill
+    if nb, err := l.cfg.LevelInt(level, "rate.refill"); err == nil {
+        b.refill = float64(nb)
+    } else if nb, err := l.cfg.Int("global.rate.refill"); err == nil {
+        b.refill = float64(nb)
+    }
+    b.tokens = b.burst
+    return &b
+}
+
+/* Forget the buckets which are full again, they are the same as new ones */
+func (l *Limiter) prune(now time.Time) {
+    for key, b := range l.buckets {
+        b.fill(now)
+        if !b.pending && b.tokens >= b.burst {
+            delete(l.buckets, key)
+        }
+    }
+}
+
+func (b *bucket) fill(now time.Time) {
+    b.tokens += now.Sub(b.last).Seconds() * b.refill
+    if b.tokens > b.burst {
+        b.tokens = b.burst
+    }
+    b.last = now
+}
+
+/* Whether the order may be sent to the queue. Only the notifications are
+ * limited, and a burst of 0 disables the limit of their level. */
+func (l *Limiter) Allow(order types.Order) bool {
+    ord, ok := order.(types.NotifOrder)
+    if !ok {
+        return true
+    }
+
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+    now := time.Now()
+    key := ord.Level + "\x00" + client(ord)
+    b, ok := l.buckets[key]
+    if !ok {
+        if len(l.buckets) >= maxBuckets {
+            l.prune(now)
+        }
+        b = l.newBucket(ord.Level, client(ord), now)
+        l.buckets[key] = b
+    }
+    if b.burst <= 0 {
+        return true
+    }
+
+    b.fill(now)
+    if b.tokens >= 1 {
+        b.tokens--
+        return true
+    }
+
+    b.dropped++
+    if !b.pending && b.refill > 0 {
+        b.pending = true
+        l.schedule(b, now)
+    }
+    return false
+}
+
+/* Send the summary of b once a token is available again */
+func (l *Limiter) schedule(b *bucket, now time.Time) {
+    wait := time.Duration((1 - b.tokens) / b.refill * float64(time.Second))
+    time.AfterFunc(wait, func() {
+        l.summarize(b)
+    })
+}
+
+func (l *Limiter) summarize(b *bucket) {
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+    now := time.Now()
+    b.fill(now)
+
+    text := fmt.Sprintf("%v notifications from %v dropped", b.dropped, b.client)
+    ord := types.NotifOrder{Time: summaryTime, Level: b.level, Text: text, Screen: -1}
+    /* Never block the caller : try again later if the queue is flooded */
+    select {
+    case l.orders <- ord:
+        b.tokens--
+        b.dropped = 0
+        b.pending = false
+    default:
+        b.tokens = 0
+        l.schedule(b, now)
+    }
+}
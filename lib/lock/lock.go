@@ -0,0 +1,105 @@
+package lock
+
+import (
+    "fmt"
+    "os"
+    "time"
+    "strconv"
+    "strings"
+    "syscall"
+)
+
+const (
+    lockName = "xcbnotif.lock"
+    /* How long a new instance waits for the running one to hand over */
+    replaceTimeout = 5 * time.Second
+)
+
+/* A lock held by the running instance, which holds its pid */
+type Lock struct {
+    path string
+    file *os.File
+}
+
+type RunningError int
+func (e RunningError) Error() string {
+    return fmt.Sprintf("xcbnotif is already running (pid %v), use --replace to take over",
+                       int(e))
+}
+
+type ReplaceTimeoutError int
+func (e ReplaceTimeoutError) Error() string {
+    return fmt.Sprintf("the running instance (pid %v) did not exit", int(e))
+}
+
+func runtimeDir() string {
+    dir := os.Getenv("XDG_RUNTIME_DIR")
+    if dir == "" {
+        dir = "/tmp"
+    }
+    return dir
+}
+
+func readPid(file *os.File) int {
+    data := make([]byte, 32)
+    n, _ := file.ReadAt(data, 0)
+    pid, err := strconv.Atoi(strings.TrimSpace(string(data[:n])))
+    if err != nil {
+        return 0
+    }
+    return pid
+}
+
+/* Take the lock of the single instance. If another instance holds it, fail
+ * with a RunningError, or if replace is set ask it to hand over with SIGUSR1
+ * and wait for it to exit. */
+func Acquire(replace bool) (*Lock, error) {
+    var l Lock
+    l.path = runtimeDir() + "/" + lockName
+    file, err := os.OpenFile(l.path, os.O_RDWR | os.O_CREATE, 0600)
+    if err != nil {
+        return nil, err
+    }
+
+    err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX | syscall.LOCK_NB)
+    if err == syscall.EWOULDBLOCK {
+        pid := readPid(file)
+        if !replace {
+            file.Close()
+            return nil, RunningError(pid)
+        }
+        if pid != 0 {
+            syscall.Kill(pid, syscall.SIGUSR1)
+        }
+        err = waitLock(file, pid)
+    }
+    if err != nil {
+        file.Close()
+        return nil, err
+    }
+
+    file.Truncate(0)
+    file.WriteAt([]byte(strconv.Itoa(os.Getpid()) + "\n"), 0)
+    l.file = file
+    return &l, nil
+}
+
+/* The lock is released when the running instance exits */
+func waitLock(file *os.File, pid int) error {
+    deadline := time.Now().Add(replaceTimeout)
+    for time.Now().Before(deadline) {
+        err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX | syscall.LOCK_NB)
+        if err != syscall.EWOULDBLOCK {
+            return err
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+    return ReplaceTimeoutError(pid)
+}
+
+/* The lock file is never removed : an instance waiting for it would then
+ * hold a lock on a file nobody else sees */
+func (l *Lock) Release() {
+    syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+    l.file.Close()
+}
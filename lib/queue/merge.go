@@ -0,0 +1,152 @@
+package queue
+
+import (
+    "fmt"
+    "time"
+    "strings"
+
+    "github.com/lucas8/notifier/lib/types"
+)
+
+/* How many texts of a group are kept, to list them when it is expanded */
+const maxEntries = 50
+
+/* The text shown for a notification : its counter if it has been repeated,
+ * or the last texts of its group */
+func (q *Queue) display(not *notif) string {
+    if not.count <= 1 {
+        return not.text
+    }
+    if not.group == "" {
+        return fmt.Sprintf("%v (×%v)", not.text, not.count)
+    }
+
+    shown := q.groupSize
+    if not.expanded {
+        shown = len(not.entries)
+    }
+    lines := []string{fmt.Sprintf("%v (%v)", not.group, not.count)}
+    for i := len(not.entries) - 1; i >= 0 && len(lines) <= shown; i-- {
+        lines = append(lines, not.entries[i])
+    }
+    return strings.Join(lines, "\n")
+}
+
+/* Show the notification again after its text changed. It is drawn in its
+ * window when the size is the same, to avoid the flicker and the window
+ * manager handling a new window, and a new window is opened otherwise. */
+func (q *Queue) refresh(not *notif) error {
+    text := q.display(not)
+    if not.win.SetText(not.level, text) {
+        return nil
+    }
+    win, err := q.theme.Open(q.conn, not.level, "Notification", text)
+    if err != nil {
+        return err
+    }
+    not.win.Close()
+    not.win = win
+    not.onScreen = false
+    q.updatePos(not.screen)
+    return nil
+}
+
+/* Whether ord, received at now, repeats the notification : same level and
+ * text, less than window after it was last sent. A window of 0 disables the
+ * coalescing. */
+func repeats(not *notif, ord types.NotifOrder, window time.Duration, now time.Time) bool {
+    return window > 0 && not.group == "" && not.level == ord.Level &&
+           not.text == ord.Text && now.Sub(not.seen) < window
+}
+
+/* A visible notification repeated by ord, or nil */
+func (q *Queue) findDuplicate(ord types.NotifOrder) *notif {
+    now := time.Now()
+    for _, not := range q.scrs {
+        for ; not != nil; not = not.next {
+            if repeats(not, ord, q.coalesce, now) {
+                return not
+            }
+        }
+    }
+    return nil
+}
+
+/* Merge a repeated notification with the visible one : its timeout starts
+ * again, and a counter is added to the text. It is shown again, so the show
+ * hook runs for each repeat, like for a grouped notification. */
+func (q *Queue) coalesceNotif(not *notif, ord types.NotifOrder) error {
+    not.count++
+    not.seen = time.Now()
+    if err := q.refresh(not); err != nil {
+        not.count--
+        return err
+    }
+    q.setTimer(not, ord.Time)
+    not.addWaiter(ord)
+    q.hook(not, "show")
+    return nil
+}
+
+/* The group of a notification, empty if it is not grouped */
+func (q *Queue) groupKey(ord types.NotifOrder) string {
+    if q.groupSize <= 0 {
+        return ""
+    }
+    if ord.Group != "" {
+        return ord.Group
+    }
+    return ord.App
+}
+
+/* The visible notification of the group of ord, or nil */
+func (q *Queue) findGroup(ord types.NotifOrder) *notif {
+    key := q.groupKey(ord)
+    if key == "" {
+        return nil
+    }
+    for _, not := range q.scrs {
+        for ; not != nil; not = not.next {
+            if not.group == key {
+                return not
+            }
+        }
+    }
+    return nil
+}
+
+/* Add a notification to the window of its group, which takes its level and
+ * timeout */
+func (q *Queue) groupNotif(not *notif, ord types.NotifOrder) error {
+    not.count++
+    not.seen = time.Now()
+    q.setLevel(not, ord.Level)
+    not.text = ord.Text
+    not.entries = append(not.entries, ord.Text)
+    if len(not.entries) > maxEntries {
+        not.entries = not.entries[len(not.entries) - maxEntries:]
+    }
+    if err := q.refresh(not); err != nil {
+        return err
+    }
+    q.setTimer(not, ord.Time)
+    not.addWaiter(ord)
+    q.hook(not, "show")
+    return nil
+}
+
+/* A click is told to the waiting clients. On a group, it lists all its texts,
+ * or only the last ones again */
+func (q *Queue) click(ord types.ClickOrder) {
+    not := q.findNotifByWin(ord.Win)
+    if not == nil {
+        return
+    }
+    q.hook(not, "click", fmt.Sprintf("XCBNOTIF_BUTTON=%v", ord.Button))
+    not.signalClicked(ord.Button)
+    if not.group == "" || len(not.entries) <= q.groupSize {
+        return
+    }
+    not.expanded = !not.expanded
+    q.refresh(not)
+}
@@ -0,0 +1,98 @@
+package queue
+
+import (
+    "testing"
+    "time"
+
+    "github.com/lucas8/notifier/lib/types"
+)
+
+func TestRepeats(t *testing.T) {
+    seen := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+    not := &notif{level: "normal", text: "disk full", seen: seen}
+    same := types.NotifOrder{Time: 5, Level: "normal", Text: "disk full", Screen: -1}
+    other := types.NotifOrder{Time: 5, Level: "urgent", Text: "disk full", Screen: -1}
+    window := 10 * time.Second
+
+    tests := []struct {
+        name   string
+        ord    types.NotifOrder
+        window time.Duration
+        now    time.Time
+        want   bool
+    }{
+        {"inside the window", same, window, seen.Add(window - time.Nanosecond), true},
+        {"just after the window", same, window, seen.Add(window), false},
+        {"different level", other, window, seen.Add(time.Second), false},
+        {"coalescing disabled", same, 0, seen.Add(time.Second), false},
+    }
+    for _, test := range tests {
+        if got := repeats(not, test.ord, test.window, test.now); got != test.want {
+            t.Errorf("%v : repeats is %v, expected %v", test.name, got, test.want)
+        }
+    }
+}
+
+/* The clients waiting on a notification are told of the clicks, and those
+ * which did not read the previous one miss the next instead of blocking */
+func TestClickSignalsWaiters(t *testing.T) {
+    q, _ := openFakeQueue(t, 2)
+    not := q.scrs[0].next
+    closed := make(chan uint32, 1)
+    clicked := make(chan byte, 1)
+    not.addWaiter(types.NotifOrder{Closed: closed, Clicked: clicked})
+
+    q.click(types.ClickOrder{not.win.Id(), 3})
+    q.click(types.ClickOrder{not.win.Id(), 1})
+    select {
+    case button := <-clicked:
+        if button != 3 {
+            t.Errorf("received the button %v, expected 3", button)
+        }
+    default:
+        t.Fatal("the click was not signaled")
+    }
+    select {
+    case id := <-closed:
+        t.Errorf("the notification %v was signaled as closed by a click", id)
+    default:
+    }
+
+    q.click(types.ClickOrder{q.scrs[0].win.Id(), 1})
+    select {
+    case button := <-clicked:
+        t.Errorf("a click on another notification was signaled, button %v", button)
+    default:
+    }
+}
+
+/* A repeat keeping the size of the notification is drawn in its window */
+func TestRefreshKeepsWindow(t *testing.T) {
+    q, x := openFakeQueue(t, 2)
+    not := q.scrs[0].next
+    not.text = "Some text to show"
+    not.count = 2
+    win := not.win
+
+    if err := q.refresh(not); err != nil {
+        t.Fatal(err)
+    }
+    if not.win != win {
+        t.Errorf("a new window was opened for the same size")
+    }
+    requests, copies := x.since(q.conn)
+    for _, op := range requests {
+        if op == opCreateWindow || op == opDestroyWindow {
+            t.Errorf("refresh sent the requests %v, the window must be kept", requests)
+            break
+        }
+    }
+    if len(copies) != 1 || copies[0] != win.Id() {
+        t.Errorf("refresh copied on the windows %v, expected only %v", copies, win.Id())
+    }
+
+    /* More lines need a bigger window */
+    if win.SetText("normal", "one\ntwo") {
+        t.Errorf("a text with more lines was drawn in the same window")
+    }
+}
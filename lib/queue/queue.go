@@ -1,12 +1,17 @@
 package queue
 
 import (
+    "os"
+    "fmt"
+    "time"
     "github.com/BurntSushi/xgb"
 
     "github.com/lucas8/notifier/lib/types"
     "github.com/lucas8/notifier/lib/window"
     "github.com/lucas8/notifier/lib/screens"
     "github.com/lucas8/notifier/lib/config"
+    "github.com/lucas8/notifier/lib/rules"
+    "github.com/lucas8/notifier/lib/hooks"
 )
 
 const (
@@ -21,6 +26,26 @@ type notif struct {
     screen int
     id uint32
     win *window.Window
+    /* What the notification was opened with, to hand it over */
+    level string
+    text string
+    /* The priority of its level, the higher ones are shown first */
+    priority int32
+    /* When the notification closes itself, zero if it stays until closed */
+    expires time.Time
+    timer *time.Timer
+    /* How many times it has been sent, and when it was last sent */
+    count int
+    seen time.Time
+    /* The group of the notification if grouping is enabled, its last texts,
+     * and whether all of them are listed */
+    group string
+    entries []string
+    expanded bool
+    /* Where to signal the closing of the notification and the clicks on it,
+     * one channel for each client waiting on it */
+    closed []chan<- uint32
+    clicked []chan<- byte
 
     next *notif
     prev *notif
@@ -28,24 +53,54 @@ type notif struct {
 
 type Queue struct {
     conn *xgb.Conn
+    layout *screens.Layout
+    theme *window.Theme
+    rules *rules.Rules
+    hooks *hooks.Hooks
     /* The notifications for each screen */
     scrs []*notif
     mid uint32
+    /* The ids below are reserved in the state file, see reserveId */
+    reserved uint32
+    /* Receives the ids of the notifications whose timer fired */
+    expired chan uint32
+
+    /* How long a repeated notification is merged with the first one */
+    coalesce time.Duration
+    /* How many texts a group lists, 0 if grouping is disabled */
+    groupSize int
+    /* The priority of each level */
+    priorities map[string]int32
+
+    statePath string
+    saveInterval time.Duration
 
     gravity int
+    /* Whether the new notifications are shown before the older ones of the
+     * same priority */
+    newestFirst bool
     vertPad uint32
     horiPad uint32
     space   uint32
     initPad uint32
 }
 
-func Open(c *xgb.Conn) (*Queue, error) {
+func Open(c *xgb.Conn, cfg *config.Tree, layout *screens.Layout,
+          theme *window.Theme) (*Queue, error) {
     var q Queue
     q.conn = c
-    q.scrs = make([]*notif, screens.Count())
+    q.layout = layout
+    q.theme = theme
+    q.scrs = make([]*notif, layout.Count())
+    q.hooks = hooks.Load(cfg)
+    if rs, err := rules.Load(cfg, q.hooks); err != nil {
+        return nil, err
+    } else {
+        q.rules = rs
+    }
 
     q.gravity = grTopRight
-    if gr, err := config.String("global.gravity"); err == nil {
+    if gr, err := cfg.String("global.gravity"); err == nil {
         switch gr {
         case "top_left":     q.gravity = grTopLeft
         case "top_right":    q.gravity = grTopRight
@@ -54,22 +109,60 @@ func Open(c *xgb.Conn) (*Queue, error) {
         }
     }
 
+    q.newestFirst = false
+    if ord, err := cfg.String("global.order"); err == nil {
+        q.newestFirst = ord == "newest_first"
+    }
+
     q.vertPad = 15
-    if nb, err := config.Int("global.padding.vert"); err == nil {
+    if nb, err := cfg.Int("global.padding.vert"); err == nil {
         q.vertPad = uint32(nb)
     }
 
     q.horiPad = 15
-    if nb, err := config.Int("global.padding.hori"); err == nil {
+    if nb, err := cfg.Int("global.padding.hori"); err == nil {
         q.horiPad = uint32(nb)
     }
 
     q.space = 15
-    if nb, err := config.Int("global.padding.space"); err == nil {
+    if nb, err := cfg.Int("global.padding.space"); err == nil {
         q.space = uint32(nb)
     }
 
-    q.mid = 0
+    q.coalesce = 0
+    if nb, err := cfg.Int("global.coalesce"); err == nil {
+        q.coalesce = time.Duration(nb) * time.Second
+    }
+
+    q.priorities = make(map[string]int32)
+    for _, lvl := range cfg.Levels() {
+        if nb, err := cfg.LevelInt(lvl, "priority"); err == nil {
+            q.priorities[lvl] = nb
+        }
+    }
+
+    q.groupSize = 0
+    if nb, err := cfg.Int("global.group_size"); err == nil {
+        q.groupSize = int(nb)
+    }
+
+    dir := os.Getenv("XDG_RUNTIME_DIR")
+    if dir == "" {
+        dir = "/tmp"
+    }
+    q.statePath = dir + "/xcbnotif.state"
+    if path, err := cfg.String("global.state"); err == nil {
+        q.statePath = path
+    }
+
+    q.saveInterval = 30 * time.Second
+    if nb, err := cfg.Int("global.state_interval"); err == nil {
+        q.saveInterval = time.Duration(nb) * time.Second
+    }
+
+    /* 0 is never used as an id, it means no notification to replace */
+    q.mid = 1
+    q.expired = make(chan uint32, 10)
     return &q, nil
 }
 
@@ -78,54 +171,139 @@ func (e ClosedChannelError) Error() string {
     return "closed order channel"
 }
 
+func (n *notif) signalClosed() {
+    for _, c := range n.closed {
+        c <- n.id
+    }
+    n.closed = nil
+    n.clicked = nil
+}
+
+/* Tell the waiting clients the notification was clicked. The queue never
+ * waits on them : a client which did not read the previous click misses it. */
+func (n *notif) signalClicked(button byte) {
+    for _, c := range n.clicked {
+        select {
+        case c <- button:
+        default:
+        }
+    }
+}
+
+/* Record the channels of a client waiting on the notification opened by ord */
+func (n *notif) addWaiter(ord types.NotifOrder) {
+    if ord.Closed != nil {
+        n.closed = append(n.closed, ord.Closed)
+    }
+    if ord.Clicked != nil {
+        n.clicked = append(n.clicked, ord.Clicked)
+    }
+}
+
+/* Arm the timer of the notification for timeout seconds, 0 to disarm it */
+func (q *Queue) setTimer(n *notif, timeout uint32) {
+    if n.timer != nil {
+        n.timer.Stop()
+        n.timer = nil
+    }
+    n.expires = time.Time{}
+    if timeout == 0 {
+        return
+    }
+
+    id := n.id
+    d := time.Duration(timeout) * time.Second
+    n.expires = time.Now().Add(d)
+    n.timer = time.AfterFunc(d, func() {
+        q.expired <- id
+    })
+}
+
+/* Run the hook of the level of the notification for the event */
+func (q *Queue) hook(n *notif, event string, env ...string) {
+    q.hooks.Run(n.level, event, append(env,
+        fmt.Sprintf("XCBNOTIF_ID=%v", n.id),
+        "XCBNOTIF_LEVEL=" + n.level,
+        "XCBNOTIF_TEXT=" + n.text,
+        "XCBNOTIF_GROUP=" + n.group)...)
+}
+
+/* Close the notification id if its timer fired. A timer stopped too late may
+ * still send the id, so the expiry date is checked again. */
+func (q *Queue) expire(id uint32) {
+    not := q.findNotifById(id)
+    if not == nil || not.expires.IsZero() || time.Now().Before(not.expires) {
+        return
+    }
+    q.closeNotif(not)
+}
+
 func (q *Queue) closeAllNotif() {
     for i, not := range q.scrs {
         for not != nil {
+            q.setTimer(not, 0)
             not.win.Close()
+            not.signalClosed()
             not = not.next
         }
         q.scrs[i] = nil
     }
 }
 
+/* Forget the notifications without closing their windows, when the
+ * connection is lost */
+func (q *Queue) dropAllNotif() {
+    for i, not := range q.scrs {
+        for ; not != nil; not = not.next {
+            q.setTimer(not, 0)
+            not.signalClosed()
+        }
+        q.scrs[i] = nil
+    }
+}
+
+/* Place the notifications of the screen in their order. Those which don't fit
+ * are unmapped until some space is freed. */
 func (q *Queue) updatePos(scr int) {
     not := q.scrs[scr]
     y := int32(q.space)
-    g, _ := screens.Geom(uint32(scr))
-    for not != nil && y < g.H {
+    g, _ := q.layout.Geom(uint32(scr))
+    for ; not != nil; not = not.next {
         gn := not.win.Geom()
         yn := y + int32(q.space) + gn.H
-        if yn <= g.H {
-            ym := y
-            xm := int32(0)
-            switch q.gravity {
-            case grTopRight:
-                xm = g.W - gn.W - int32(q.vertPad)
-            case grTopLeft:
-                xm = int32(q.vertPad)
-            case grBottomLeft:
-                xm = int32(q.vertPad)
-                ym = g.H - y - gn.H
-            case grBottomRight:
-                xm = g.W - gn.W - int32(q.vertPad)
-                ym = g.H - y - gn.H
-            }
-            not.win.Move(uint32(g.X + xm), uint32(g.Y + ym))
-            if !not.onScreen {
-                not.win.Map()
-                not.onScreen = true
+        if yn > g.H {
+            if not.onScreen {
+                not.win.Unmap()
+                not.onScreen = false
             }
+            continue
+        }
+
+        ym := y
+        xm := int32(0)
+        switch q.gravity {
+        case grTopRight:
+            xm = g.W - gn.W - int32(q.vertPad)
+        case grTopLeft:
+            xm = int32(q.vertPad)
+        case grBottomLeft:
+            xm = int32(q.vertPad)
+            ym = g.H - y - gn.H
+        case grBottomRight:
+            xm = g.W - gn.W - int32(q.vertPad)
+            ym = g.H - y - gn.H
+        }
+        not.win.Move(uint32(g.X + xm), uint32(g.Y + ym))
+        if !not.onScreen {
+            not.win.Map()
+            not.onScreen = true
         }
         y = yn
-        not = not.next
     }
 }
 
-func (q *Queue) closeNotif(n *notif) {
-    if n == nil {
-        return
-    }
-
+/* Remove n from the notifications of its screen */
+func (q *Queue) unlink(n *notif) {
     if n.prev != nil {
         n.prev.next = n.next
     }
@@ -135,7 +313,60 @@ func (q *Queue) closeNotif(n *notif) {
     if q.scrs[n.screen] == n {
         q.scrs[n.screen] = n.next
     }
+    n.next = nil
+    n.prev = nil
+}
+
+/* Whether n is shown before p : it has a higher priority, or the same one
+ * and the newest are shown first */
+func (q *Queue) before(n, p *notif) bool {
+    return p.priority < n.priority || (q.newestFirst && p.priority == n.priority)
+}
+
+/* Insert n in the notifications of its screen. The first one of the list is
+ * the nearest to the corner, and the first one closed by close. */
+func (q *Queue) insert(n *notif) {
+    p := q.scrs[n.screen]
+    if p == nil || q.before(n, p) {
+        n.prev = nil
+        n.next = p
+        if p != nil {
+            p.prev = n
+        }
+        q.scrs[n.screen] = n
+        return
+    }
+    for p.next != nil && !q.before(n, p.next) {
+        p = p.next
+    }
+    n.prev = p
+    n.next = p.next
+    if p.next != nil {
+        p.next.prev = n
+    }
+    p.next = n
+}
+
+/* Change the level of n, moving it if its priority changes */
+func (q *Queue) setLevel(n *notif, level string) {
+    n.level = level
+    if prio := q.priorities[level]; prio != n.priority {
+        n.priority = prio
+        q.unlink(n)
+        q.insert(n)
+    }
+}
+
+func (q *Queue) closeNotif(n *notif) {
+    if n == nil {
+        return
+    }
+
+    q.unlink(n)
+    q.hook(n, "close")
+    q.setTimer(n, 0)
     n.win.Close()
+    n.signalClosed()
     q.updatePos(n.screen)
 }
 
@@ -151,32 +382,101 @@ func (q *Queue) findNotifById(id uint32) *notif {
     return nil
 }
 
-func (q *Queue) openNotif(lvl, txt string, time uint32) {
-    /* TODO handle time */
-    var not notif
-    scr := screens.Focused(q.conn)
+/* Replace the content of an existing notification, keeping its place */
+func (q *Queue) replaceNotif(not *notif, ord types.NotifOrder) error {
+    win, err := q.theme.Open(q.conn, ord.Level, "Notification", ord.Text)
+    if err != nil {
+        return err
+    }
+    not.win.Close()
+    not.win = win
     not.onScreen = false
-    not.screen = int(scr)
-    not.id = q.mid
+    q.setLevel(not, ord.Level)
+    not.text = ord.Text
+    not.count = 1
+    not.seen = time.Now()
+    not.entries = []string{ord.Text}
+    q.setTimer(not, ord.Time)
+    if ord.Closed != nil || ord.Clicked != nil {
+        not.signalClosed()
+        not.addWaiter(ord)
+    }
+    q.updatePos(not.screen)
+    q.hook(not, "show")
+    return nil
+}
+
+func (q *Queue) openNotif(ord types.NotifOrder) (uint32, error) {
+    if ord.Replace != 0 {
+        if not := q.findNotifById(ord.Replace); not != nil {
+            return not.id, q.replaceNotif(not, ord)
+        }
+    } else if not := q.findGroup(ord); not != nil {
+        return not.id, q.groupNotif(not, ord)
+    } else if not := q.findDuplicate(ord); not != nil {
+        return not.id, q.coalesceNotif(not, ord)
+    }
+
+    scr := ord.Screen
+    if scr < 0 || scr >= len(q.scrs) {
+        scr = int(q.layout.Focused(q.conn))
+    }
+    q.reserveId()
+    not, err := q.pushNotif(ord, q.mid, scr)
+    if err != nil {
+        return 0, err
+    }
     q.mid++
-    not.win, _ = window.Open(q.conn, lvl, "Notification", txt)
-    not.next = nil
+    q.hook(not, "show")
+    return not.id, nil
+}
 
-    if q.scrs[scr] == nil {
-        not.prev = nil
-        q.scrs[scr] = &not
-    } else {
-        p := q.scrs[scr]
-        for p.next != nil {
-            p = p.next
+/* Open a window for ord and add it at the end of the notifications of scr */
+func (q *Queue) pushNotif(ord types.NotifOrder, id uint32, scr int) (*notif, error) {
+    var not notif
+    win, err := q.theme.Open(q.conn, ord.Level, "Notification", ord.Text)
+    if err != nil {
+        return nil, err
+    }
+    not.onScreen = false
+    not.screen = scr
+    not.id = id
+    not.win = win
+    not.level = ord.Level
+    not.priority = q.priorities[ord.Level]
+    not.text = ord.Text
+    not.count = 1
+    not.seen = time.Now()
+    not.group = q.groupKey(ord)
+    not.entries = []string{ord.Text}
+    not.addWaiter(ord)
+
+    q.insert(&not)
+    q.setTimer(&not, ord.Time)
+    q.updatePos(scr)
+    return &not, nil
+}
+
+func (q *Queue) findNotifByWin(win uint32) *notif {
+    for _, not := range q.scrs {
+        for not != nil {
+            if not.win.Id() == win {
+                return not
+            }
+            not = not.next
         }
-        p.next = &not
-        not.prev = p
     }
-    q.updatePos(int(scr))
+    return nil
 }
 
-func (q *Queue) redraw() {
+func (q *Queue) redraw(ord types.RedrawOrder) {
+    if !ord.All {
+        if not := q.findNotifByWin(ord.Win); not != nil {
+            not.win.RedrawArea(ord.Area)
+        }
+        return
+    }
+
     for _, not := range q.scrs {
         for not != nil {
             not.win.Redraw()
@@ -185,31 +485,96 @@ func (q *Queue) redraw() {
     }
 }
 
-/* Will run processing incoming orders from c until it is killed (return nil)
- * or a fatal error happen (return it)
+/* Will run processing the orders from the clients on orders, and from the X
+ * server and the signals on events, and closing the notifications whose timer
+ * fired, until it is killed (return nil) or a fatal error happen (return it).
+ * The state is saved on the way out, and every saveInterval if it is positive.
  */
-func (q *Queue) Run(c chan types.Order) error {
-    o, ok := <-c
-    for ok {
-        switch ord := o.(type) {
-        case types.KillOrder:
-            return nil
-        case types.CloseOrder:
-            if ord.All {
-                q.closeAllNotif()
-            } else if ord.Top {
-                scr := screens.Focused(q.conn)
-                q.closeNotif(q.scrs[scr])
-            } else {
-                q.closeNotif(q.findNotifById(ord.Id))
+func (q *Queue) Run(orders, events <-chan types.Order) error {
+    var tick <-chan time.Time
+    if q.saveInterval > 0 {
+        ticker := time.NewTicker(q.saveInterval)
+        defer ticker.Stop()
+        tick = ticker.C
+    }
+
+    for {
+        select {
+        case o, ok := <-orders:
+            if !ok {
+                return ClosedChannelError{}
+            }
+            if done, err := q.order(o); done {
+                return err
+            }
+        case o, ok := <-events:
+            if !ok {
+                return ClosedChannelError{}
+            }
+            if done, err := q.order(o); done {
+                return err
+            }
+        case id := <-q.expired:
+            q.expire(id)
+        case <-tick:
+            if err := q.save(); err != nil {
+                fmt.Printf("Error while saving the state : %s\n", err)
             }
-        case types.NotifOrder:
-            q.openNotif(ord.Level, ord.Text, ord.Time)
-        case types.RedrawOrder:
-            q.redraw()
         }
-        o, ok = <-c
     }
-    return ClosedChannelError{}
 }
 
+/* Execute an order, returns true if the queue must stop */
+func (q *Queue) order(o types.Order) (bool, error) {
+    switch ord := o.(type) {
+    case types.KillOrder:
+        if err := q.save(); err != nil {
+            fmt.Printf("Error while saving the state : %s\n", err)
+        }
+        if ord.Err != nil {
+            q.dropAllNotif()
+        } else {
+            q.closeAllNotif()
+        }
+        return true, ord.Err
+    case types.CloseOrder:
+        if ord.All {
+            for _, not := range q.scrs {
+                for ; not != nil; not = not.next {
+                    q.hook(not, "close")
+                }
+            }
+            q.closeAllNotif()
+        } else if ord.Top {
+            scr := q.layout.Focused(q.conn)
+            q.closeNotif(q.scrs[scr])
+        } else {
+            q.closeNotif(q.findNotifById(ord.Id))
+        }
+    case types.NotifOrder:
+        var id uint32
+        var err error
+        ord, show := q.rules.Apply(ord)
+        if show {
+            id, err = q.openNotif(ord)
+        } else if ord.Closed != nil {
+            /* A suppressed notification is closed at once, with the id 0 */
+            ord.Closed <- 0
+        }
+        if ord.Reply != nil {
+            ord.Reply <- types.Reply{id, err}
+        }
+    case types.RedrawOrder:
+        q.redraw(ord)
+    case types.HandoverOrder:
+        return true, q.Handover()
+    case types.ClickOrder:
+        q.click(ord)
+    case types.WorkareaOrder:
+        q.layout.Update(q.conn)
+        for scr := range q.scrs {
+            q.updatePos(scr)
+        }
+    }
+    return false, nil
+}
@@ -0,0 +1,225 @@
+package queue
+
+import (
+    "io"
+    "io/ioutil"
+    "log"
+    "net"
+    "path/filepath"
+    "sync"
+    "testing"
+    "github.com/BurntSushi/xgb"
+    "github.com/BurntSushi/xgb/xproto"
+
+    "github.com/lucas8/notifier/lib/types"
+    "github.com/lucas8/notifier/lib/window"
+    "github.com/lucas8/notifier/lib/config"
+    "github.com/lucas8/notifier/lib/hooks"
+)
+
+const (
+    opCreateWindow     = 1
+    opDestroyWindow    = 4
+    opInternAtom       = 16
+    opGetInputFocus    = 43
+    opQueryFont        = 47
+    opQueryTextExtents = 48
+    opCopyArea         = 62
+    opAllocColor       = 84
+    opQueryExtension   = 98
+)
+
+/* A fake X server recording the requests it receives. It answers the few
+ * requests with a reply the notifications need, and reports no extension. */
+type fakeX struct {
+    mutex sync.Mutex
+    requests []byte
+    /* The destination of each CopyArea */
+    copies []uint32
+}
+
+func setupBytes() []byte {
+    scr := xproto.ScreenInfo{Root: 1, DefaultColormap: 2, RootVisual: 3, RootDepth: 24,
+                             WidthInPixels: 1920, HeightInPixels: 1080}
+    info := xproto.SetupInfo{Status: 1, ProtocolMajorVersion: 11,
+                             ResourceIdBase: 0x200000, ResourceIdMask: 0x1fffff,
+                             MaximumRequestLength: 0xffff, RootsLen: 1,
+                             Roots: []xproto.ScreenInfo{scr}}
+    buf := info.Bytes()
+    xgb.Put16(buf[6:], uint16((len(buf) - 8) / 4))
+    return buf
+}
+
+func (x *fakeX) reply(opcode byte, seq uint16) []byte {
+    var buf []byte
+    switch opcode {
+    case opQueryFont:
+        buf = make([]byte, 60)
+        xgb.Put16(buf[52:], 10)
+        xgb.Put16(buf[54:], 3)
+    case opQueryTextExtents:
+        buf = make([]byte, 32)
+        xgb.Put32(buf[16:], 30)
+    case opInternAtom:
+        buf = make([]byte, 32)
+        xgb.Put32(buf[8:], uint32(seq))
+    case opGetInputFocus, opAllocColor, opQueryExtension:
+        buf = make([]byte, 32)
+    default:
+        return nil
+    }
+    buf[0] = 1
+    xgb.Put16(buf[2:], seq)
+    xgb.Put32(buf[4:], uint32((len(buf) - 32) / 4))
+    return buf
+}
+
+func (x *fakeX) serve(conn net.Conn) {
+    head := make([]byte, 12)
+    if _, err := io.ReadFull(conn, head); err != nil {
+        return
+    }
+    auth := make([]byte, xgb.Pad(int(xgb.Get16(head[6:]))) + xgb.Pad(int(xgb.Get16(head[8:]))))
+    if _, err := io.ReadFull(conn, auth); err != nil {
+        return
+    }
+    if _, err := conn.Write(setupBytes()); err != nil {
+        return
+    }
+
+    var seq uint16
+    for {
+        head = make([]byte, 4)
+        if _, err := io.ReadFull(conn, head); err != nil {
+            return
+        }
+        body := make([]byte, int(xgb.Get16(head[2:])) * 4 - 4)
+        if _, err := io.ReadFull(conn, body); err != nil {
+            return
+        }
+        seq++
+
+        x.mutex.Lock()
+        x.requests = append(x.requests, head[0])
+        if head[0] == opCopyArea {
+            x.copies = append(x.copies, xgb.Get32(body[4:]))
+        }
+        x.mutex.Unlock()
+
+        if rep := x.reply(head[0], seq); rep != nil {
+            if _, err := conn.Write(rep); err != nil {
+                return
+            }
+        }
+    }
+}
+
+/* Forget the requests received so far. The round trip makes sure the server
+ * has read all the requests sent before. */
+func (x *fakeX) reset(c *xgb.Conn) {
+    xproto.GetInputFocus(c).Reply()
+    x.mutex.Lock()
+    x.requests = nil
+    x.copies = nil
+    x.mutex.Unlock()
+}
+
+/* The requests received since the last reset. The round trips, ours and the
+ * ones xgb makes when too many requests have no reply, are left out. */
+func (x *fakeX) since(c *xgb.Conn) ([]byte, []uint32) {
+    xproto.GetInputFocus(c).Reply()
+    x.mutex.Lock()
+    defer x.mutex.Unlock()
+    var requests []byte
+    for _, op := range x.requests {
+        if op != opGetInputFocus {
+            requests = append(requests, op)
+        }
+    }
+    return requests, x.copies
+}
+
+/* A queue holding nb notifications on one screen, connected to a fake X
+ * server */
+func openFakeQueue(tb testing.TB, nb int) (*Queue, *fakeX) {
+    xgb.Logger = log.New(ioutil.Discard, "", 0)
+    client, server := net.Pipe()
+    x := &fakeX{}
+    go x.serve(server)
+    c, err := xgb.NewConnNet(client)
+    if err != nil {
+        tb.Fatal(err)
+    }
+    tb.Cleanup(c.Close)
+
+    path := filepath.Join(tb.TempDir(), "xcbnotif.conf")
+    if err := ioutil.WriteFile(path, []byte("global.list : normal\n"), 0600); err != nil {
+        tb.Fatal(err)
+    }
+    cfg, err := config.Load(path)
+    if err != nil {
+        tb.Fatal(err)
+    }
+    theme, err := window.Load(c, cfg)
+    if err != nil {
+        tb.Fatal(err)
+    }
+
+    q := &Queue{conn: c, theme: theme, hooks: hooks.Load(cfg), scrs: make([]*notif, 1)}
+    var last *notif
+    for i := 0; i < nb; i++ {
+        win, err := theme.Open(c, "normal", "Notification", "Some text to show")
+        if err != nil {
+            tb.Fatal(err)
+        }
+        not := &notif{id: uint32(i + 1), win: win, level: "normal", prev: last}
+        if last == nil {
+            q.scrs[0] = not
+        } else {
+            last.next = not
+        }
+        last = not
+    }
+    x.reset(c)
+    return q, x
+}
+
+func expose(not *notif) types.RedrawOrder {
+    return types.RedrawOrder{false, not.win.Id(), types.Geometry{0, 0, 10, 10}}
+}
+
+func TestExposeCopiesOneWindow(t *testing.T) {
+    q, x := openFakeQueue(t, 3)
+    target := q.scrs[0].next
+    q.redraw(expose(target))
+
+    requests, copies := x.since(q.conn)
+    if len(requests) != 1 || requests[0] != opCopyArea {
+        t.Fatalf("expose sent the requests %v, expected one CopyArea", requests)
+    }
+    if copies[0] != target.win.Id() {
+        t.Errorf("expose copied on window %v, expected %v", copies[0], target.win.Id())
+    }
+}
+
+func TestExposeUnknownWindow(t *testing.T) {
+    q, x := openFakeQueue(t, 3)
+    q.redraw(types.RedrawOrder{false, 12345, types.Geometry{0, 0, 10, 10}})
+
+    if requests, _ := x.since(q.conn); len(requests) != 0 {
+        t.Errorf("expose of an unknown window sent the requests %v", requests)
+    }
+}
+
+func BenchmarkExpose(b *testing.B) {
+    q, x := openFakeQueue(b, 10)
+    ord := expose(q.scrs[0].next.next)
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        q.redraw(ord)
+    }
+    b.StopTimer()
+
+    requests, _ := x.since(q.conn)
+    b.ReportMetric(float64(len(requests)) / float64(b.N), "requests/expose")
+}
@@ -0,0 +1,156 @@
+package queue
+
+import (
+    "os"
+    "fmt"
+    "time"
+    "io/ioutil"
+    "encoding/json"
+
+    "github.com/lucas8/notifier/lib/types"
+)
+
+/* A notification as written in the state file */
+type savedNotif struct {
+    Id     uint32 `json:"id"`
+    Level  string `json:"level"`
+    Text   string `json:"text"`
+    /* When it expires in unix time, 0 if it stays until closed */
+    Expires int64 `json:"expires"`
+    Screen int    `json:"screen"`
+    /* The counter and texts of a repeated or grouped notification */
+    Count   int      `json:"count,omitempty"`
+    Group   string   `json:"group,omitempty"`
+    Entries []string `json:"entries,omitempty"`
+}
+
+/* How many ids are reserved at once in the state file */
+const idBlock = 100
+
+type state struct {
+    /* The first id not reserved, so that ids are never reused across
+     * restarts, even after a crash */
+    Mid    uint32       `json:"mid"`
+    Notifs []savedNotif `json:"notifs"`
+}
+
+/* Write the visible notifications to the state file */
+func (q *Queue) save() error {
+    var st state
+    st.Mid = q.mid
+    if q.reserved > st.Mid {
+        st.Mid = q.reserved
+    }
+    for _, not := range q.scrs {
+        for ; not != nil; not = not.next {
+            var expires int64
+            if !not.expires.IsZero() {
+                expires = not.expires.Unix()
+            }
+            saved := savedNotif{not.id, not.level, not.text, expires, not.screen,
+                                0, not.group, nil}
+            if not.count > 1 {
+                saved.Count = not.count
+                saved.Entries = not.entries
+            }
+            st.Notifs = append(st.Notifs, saved)
+        }
+    }
+
+    data, err := json.Marshal(st)
+    if err != nil {
+        return err
+    }
+    /* Renamed so that a crash never leaves a truncated state */
+    tmp := q.statePath + ".tmp"
+    if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+        return err
+    }
+    return os.Rename(tmp, q.statePath)
+}
+
+/* Make sure q.mid is reserved in the state file before it is used. The ids
+ * are reserved by blocks, so the state is only saved once every idBlock new
+ * notifications. */
+func (q *Queue) reserveId() {
+    if q.mid < q.reserved {
+        return
+    }
+    q.reserved = q.mid + idBlock
+    if err := q.save(); err != nil {
+        fmt.Printf("Error while saving the state : %s\n", err)
+    }
+}
+
+/* Write the visible notifications to the state file and close them, so that
+ * another instance can take over. The queue must not be used afterwards. */
+func (q *Queue) Handover() error {
+    err := q.save()
+    q.closeAllNotif()
+    return err
+}
+
+/* Reopen the notifications saved by a previous instance, with their ids and
+ * what remains of their timeout. The expired ones are dropped, the ones which
+ * can't be opened are skipped, and a missing state file is not an error. */
+func (q *Queue) Restore() error {
+    data, err := ioutil.ReadFile(q.statePath)
+    if os.IsNotExist(err) {
+        return nil
+    } else if err != nil {
+        return err
+    }
+
+    var st state
+    if err := json.Unmarshal(data, &st); err != nil {
+        return err
+    }
+    if st.Mid > q.mid {
+        q.mid = st.Mid
+    }
+
+    /* The saved notifications are in the order they are shown */
+    if q.newestFirst {
+        for i, j := 0, len(st.Notifs) - 1; i < j; i, j = i + 1, j - 1 {
+            st.Notifs[i], st.Notifs[j] = st.Notifs[j], st.Notifs[i]
+        }
+    }
+
+    now := time.Now()
+    for _, n := range st.Notifs {
+        /* New notifications must not reuse the ids saved */
+        if n.Id >= q.mid {
+            q.mid = n.Id + 1
+        }
+
+        var timeout uint32
+        if n.Expires != 0 {
+            left := time.Unix(n.Expires, 0).Sub(now)
+            if left <= 0 {
+                continue
+            }
+            timeout = uint32((left + time.Second - 1) / time.Second)
+        }
+
+        scr := n.Screen
+        if scr < 0 || scr >= len(q.scrs) {
+            scr = int(q.layout.Focused(q.conn))
+        }
+        ord := types.NotifOrder{Time: timeout, Level: n.Level, Text: n.Text,
+                                Group: n.Group, Screen: scr}
+        /* A notification which can't be opened again, for example because
+         * its level was removed from the config, must not prevent restoring
+         * the others */
+        not, err := q.pushNotif(ord, n.Id, scr)
+        if err != nil {
+            fmt.Printf("Can't restore the notification %v : %s\n", n.Id, err)
+            continue
+        }
+        if n.Count > 1 {
+            not.count = n.Count
+            not.entries = n.Entries
+            q.refresh(not)
+        }
+    }
+    return nil
+}
@@ -0,0 +1,54 @@
+package queue
+
+import (
+    "encoding/json"
+    "io/ioutil"
+    "path/filepath"
+    "testing"
+)
+
+func savedMid(t *testing.T, path string) uint32 {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var st state
+    if err := json.Unmarshal(data, &st); err != nil {
+        t.Fatal(err)
+    }
+    return st.Mid
+}
+
+/* The ids used must always be below the one saved, so that an instance
+ * started after a crash never reuses them */
+func TestReserveId(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "state")
+    q := &Queue{scrs: make([]*notif, 1), mid: 1, statePath: path}
+
+    for i := 0; i < 3 * idBlock; i++ {
+        q.reserveId()
+        if saved := savedMid(t, path); saved <= q.mid {
+            t.Fatalf("id %v is used but only the ids below %v are reserved", q.mid, saved)
+        } else if saved > q.mid + idBlock {
+            t.Fatalf("the ids below %v are reserved, expected at most %v", saved, q.mid + idBlock)
+        }
+        q.mid++
+    }
+
+    /* The state is only saved when a block is exhausted */
+    q.reserveId()
+    q.mid++
+    before := savedMid(t, path)
+    q.reserveId()
+    if after := savedMid(t, path); after != before {
+        t.Errorf("the reserved ids changed from %v to %v within a block", before, after)
+    }
+
+    restarted := &Queue{scrs: make([]*notif, 1), mid: 1, statePath: path}
+    if err := restarted.Restore(); err != nil {
+        t.Fatal(err)
+    }
+    if restarted.mid <= q.mid {
+        t.Errorf("restarted at id %v, but id %v was used", restarted.mid, q.mid)
+    }
+}
@@ -0,0 +1,158 @@
+package rules
+
+import (
+    "time"
+    "regexp"
+
+    "github.com/lucas8/notifier/lib/config"
+    "github.com/lucas8/notifier/lib/hooks"
+    "github.com/lucas8/notifier/lib/types"
+)
+
+/* A rule of the config, rules.<name>. The empty match entries match any
+ * notification, and the empty actions change nothing. */
+type rule struct {
+    name string
+
+    level  string
+    text   *regexp.Regexp
+    source string
+    hours  bool
+    from, to int
+
+    setLevel string
+    timeout  int32
+    hasTimeout bool
+    suppress bool
+    rewrite  string
+    hasRewrite bool
+    screen   int32
+    hasScreen bool
+    command  string
+}
+
+/* The rules applied to the notifications, in the order of global.rules */
+type Rules struct {
+    rules []rule
+    /* Runs the commands of the rules */
+    hooks *hooks.Hooks
+}
+
+/* Matches the whole text, so that $0 is the text in a rewrite */
+var wholeText = regexp.MustCompile(`(?s)^.*$`)
+
+func Load(cfg *config.Tree, h *hooks.Hooks) (*Rules, error) {
+    var rs Rules
+    rs.hooks = h
+    for _, name := range cfg.Rules() {
+        r, err := loadRule(cfg, name)
+        if err != nil {
+            return nil, err
+        }
+        rs.rules = append(rs.rules, r)
+    }
+    return &rs, nil
+}
+
+func loadRule(cfg *config.Tree, name string) (rule, error) {
+    var r rule
+    var err error
+    r.name = name
+    key := func(k string) string {
+        return "rules." + name + "." + k
+    }
+
+    r.level, _ = cfg.String(key("match.level"))
+    r.source, _ = cfg.String(key("match.source"))
+    r.text = wholeText
+    if str, e := cfg.String(key("match.text")); e == nil {
+        if r.text, err = regexp.Compile(str); err != nil {
+            return r, err
+        }
+    }
+    if str, e := cfg.String(key("match.hours")); e == nil {
+        if r.from, r.to, err = config.ParseHours(str); err != nil {
+            return r, err
+        }
+        r.hours = true
+    }
+
+    r.setLevel, _ = cfg.String(key("level"))
+    if nb, e := cfg.Int(key("timeout")); e == nil {
+        r.timeout, r.hasTimeout = nb, true
+    } else if cfg.Has(key("timeout")) {
+        return r, e
+    }
+    if b, e := cfg.Bool(key("suppress")); e == nil {
+        r.suppress = b
+    } else if cfg.Has(key("suppress")) {
+        return r, e
+    }
+    if str, e := cfg.String(key("rewrite")); e == nil {
+        r.rewrite, r.hasRewrite = str, true
+    }
+    if nb, e := cfg.Int(key("screen")); e == nil {
+        r.screen, r.hasScreen = nb, true
+    } else if cfg.Has(key("screen")) {
+        return r, e
+    }
+    r.command, _ = cfg.String(key("command"))
+    return r, nil
+}
+
+/* Whether the current time, in minutes since midnight, is in the hours */
+func inHours(now, from, to int) bool {
+    if from <= to {
+        return now >= from && now < to
+    }
+    return now >= from || now < to
+}
+
+func (r *rule) match(ord *types.NotifOrder, now time.Time) bool {
+    if r.level != "" && r.level != ord.Level {
+        return false
+    }
+    if r.source != "" && r.source != ord.Source && r.source != ord.App {
+        return false
+    }
+    if r.hours && !inHours(now.Hour() * 60 + now.Minute(), r.from, r.to) {
+        return false
+    }
+    return r.text.MatchString(ord.Text)
+}
+
+/* Apply the matching rules to the notification, each one seeing the changes
+ * of the previous ones. Returns false if it must not be shown. */
+func (rs *Rules) Apply(ord types.NotifOrder) (types.NotifOrder, bool) {
+    now := time.Now()
+    for i := range rs.rules {
+        r := &rs.rules[i]
+        if !r.match(&ord, now) {
+            continue
+        }
+
+        if r.hasRewrite {
+            ord.Text = r.text.ReplaceAllString(ord.Text, r.rewrite)
+        }
+        if r.setLevel != "" {
+            ord.Level = r.setLevel
+        }
+        if r.hasTimeout && r.timeout >= 0 {
+            ord.Time = uint32(r.timeout)
+        }
+        if r.hasScreen {
+            ord.Screen = int(r.screen)
+        }
+        if r.command != "" {
+            rs.hooks.Exec(r.command,
+                "XCBNOTIF_LEVEL=" + ord.Level,
+                "XCBNOTIF_TEXT=" + ord.Text,
+                "XCBNOTIF_SOURCE=" + ord.Source,
+                "XCBNOTIF_APP=" + ord.App)
+        }
+        if r.suppress {
+            return ord, false
+        }
+    }
+    return ord, true
+}
@@ -14,33 +14,232 @@ func (e InvalidIdError) Error() string {
     return fmt.Sprintf("Not a valid screen id : %v", uint(e))
 }
 
-var count uint32
-var sizes []types.Geometry;
+/* The geometry of the screens of an X connection */
+type Layout struct {
+    count uint32
+    sizes []types.Geometry
+    /* The part of each screen not covered by docks and panels */
+    areas []types.Geometry
+    atoms map[string]xproto.Atom
+}
+
+var atomNames = [...]string {
+    "_NET_WORKAREA",
+    "_NET_CURRENT_DESKTOP",
+    "_NET_CLIENT_LIST",
+    "_NET_WM_STRUT",
+    "_NET_WM_STRUT_PARTIAL",
+}
+func (l *Layout) loadAtoms(c *xgb.Conn) error {
+    cookies := make([]xproto.InternAtomCookie, len(atomNames))
+    for i, name := range atomNames {
+        cookies[i] = xproto.InternAtom(c, false, uint16(len(name)), name)
+    }
+
+    l.atoms = make(map[string]xproto.Atom)
+    for i, name := range atomNames {
+        rep, err := cookies[i].Reply()
+        if err != nil {
+            return err
+        }
+        l.atoms[name] = rep.Atom
+    }
+    return nil
+}
 
-func Load(c *xgb.Conn) error {
+func Load(c *xgb.Conn) (*Layout, error) {
     err := xinerama.Init(c)
     if err != nil {
-        return err
+        return nil, err
     }
 
     reply, err := xinerama.QueryScreens(c).Reply()
     if err != nil {
-        return err
+        return nil, err
     }
 
-    count = reply.Number
+    var l Layout
+    l.count = reply.Number
     for _, scr := range reply.ScreenInfo {
-        sizes = append(sizes, types.Geometry{int32(scr.XOrg),  int32(scr.YOrg),
-                                             int32(scr.Width), int32(scr.Height)})
+        l.sizes = append(l.sizes, types.Geometry{int32(scr.XOrg),  int32(scr.YOrg),
+                                                 int32(scr.Width), int32(scr.Height)})
     }
-    return nil
+
+    err = l.loadAtoms(c)
+    if err != nil {
+        return nil, err
+    }
+
+    /* Be notified when the work area or the list of clients change */
+    root := xproto.Setup(c).DefaultScreen(c).Root
+    values := make([]uint32, 1)
+    values[0] = xproto.EventMaskPropertyChange
+    err = xproto.ChangeWindowAttributesChecked(c, root, xproto.CwEventMask, values).Check()
+    if err != nil {
+        return nil, err
+    }
+
+    l.Update(c)
+    return &l, nil
+}
+
+/* Whether a change of the property on the root window, or of the strut of a
+ * client, must trigger an Update */
+func (l *Layout) Watched(atom xproto.Atom) bool {
+    return atom == l.atoms["_NET_WORKAREA"] || atom == l.atoms["_NET_CLIENT_LIST"] ||
+           atom == l.atoms["_NET_CURRENT_DESKTOP"] ||
+           atom == l.atoms["_NET_WM_STRUT"] || atom == l.atoms["_NET_WM_STRUT_PARTIAL"]
+}
+
+func cardinals(c *xgb.Conn, win xproto.Window, atom xproto.Atom, typ xproto.Atom) []uint32 {
+    rep, err := xproto.GetProperty(c, false, win, atom, typ, 0, 1024).Reply()
+    if err != nil || rep.Format != 32 {
+        return nil
+    }
+    values := make([]uint32, rep.ValueLen)
+    for i := range values {
+        values[i] = xgb.Get32(rep.Value[4*i:])
+    }
+    return values
 }
 
-func Count() uint32 {
-    return count
+func max(a, b int32) int32 {
+    if a > b {
+        return a
+    }
+    return b
 }
 
-func Focused(c *xgb.Conn) uint32 {
+func min(a, b int32) int32 {
+    if a < b {
+        return a
+    }
+    return b
+}
+
+func intersect(a, b types.Geometry) types.Geometry {
+    x1, y1 := max(a.X, b.X), max(a.Y, b.Y)
+    x2, y2 := min(a.X + a.W, b.X + b.W), min(a.Y + a.H, b.Y + b.H)
+    if x2 < x1 || y2 < y1 {
+        return types.Geometry{x1, y1, 0, 0}
+    }
+    return types.Geometry{x1, y1, x2 - x1, y2 - y1}
+}
+
+/* Reduce g by the partial strut of a dock, as described by the EWMH. The
+ * strut values are relative to the root window borders */
+func applyStrut(g types.Geometry, st []uint32, rw, rh int32) types.Geometry {
+    left, right, top, bottom := int32(st[0]), int32(st[1]), int32(st[2]), int32(st[3])
+    overlaps := func(start, end, from, length int32) bool {
+        return start < from + length && end >= from
+    }
+
+    if left > g.X && overlaps(int32(st[4]), int32(st[5]), g.Y, g.H) {
+        g.W -= left - g.X
+        g.X = left
+    }
+    if rw - right < g.X + g.W && overlaps(int32(st[6]), int32(st[7]), g.Y, g.H) {
+        g.W = rw - right - g.X
+    }
+    if top > g.Y && overlaps(int32(st[8]), int32(st[9]), g.X, g.W) {
+        g.H -= top - g.Y
+        g.Y = top
+    }
+    if rh - bottom < g.Y + g.H && overlaps(int32(st[10]), int32(st[11]), g.X, g.W) {
+        g.H = rh - bottom - g.Y
+    }
+    if g.W < 0 {
+        g.W = 0
+    }
+    if g.H < 0 {
+        g.H = 0
+    }
+    return g
+}
+
+/* Whether the window was created by this connection, ie is a notification */
+func ownWindow(setup *xproto.SetupInfo, win uint32) bool {
+    return win & ^setup.ResourceIdMask == setup.ResourceIdBase
+}
+
+/* Read the struts of all the clients, in the _NET_WM_STRUT_PARTIAL format.
+ * The property changes of the clients are selected, so that a dock changing
+ * its strut triggers an Update. */
+func (l *Layout) struts(c *xgb.Conn, root xproto.Window, rw, rh int32) [][]uint32 {
+    var res [][]uint32
+    setup := xproto.Setup(c)
+    values := []uint32{xproto.EventMaskPropertyChange}
+    for _, win := range cardinals(c, root, l.atoms["_NET_CLIENT_LIST"], xproto.AtomWindow) {
+        /* The notifications are managed clients when they don't override the
+         * redirection. Selecting the events replaces our whole event mask, so
+         * it would drop their Exposure and ButtonPress, and they have no
+         * strut anyway. */
+        if ownWindow(setup, win) {
+            continue
+        }
+        /* Not checked : the client may be gone already */
+        xproto.ChangeWindowAttributes(c, xproto.Window(win), xproto.CwEventMask, values)
+        st := cardinals(c, xproto.Window(win), l.atoms["_NET_WM_STRUT_PARTIAL"], xproto.AtomCardinal)
+        if len(st) < 12 {
+            st = cardinals(c, xproto.Window(win), l.atoms["_NET_WM_STRUT"], xproto.AtomCardinal)
+            if len(st) < 4 {
+                continue
+            }
+            /* A full strut spans the whole border */
+            st = append(st[:4], 0, uint32(rh - 1), 0, uint32(rh - 1),
+                                0, uint32(rw - 1), 0, uint32(rw - 1))
+        }
+        res = append(res, st)
+    }
+    return res
+}
+
+/* The work area of the desktop in the _NET_WORKAREA values, or nil if there
+ * is none. Any client can set the properties, so desk is not trusted. */
+func workArea(wa []uint32, desk uint32) *types.Geometry {
+    if uint64(desk) >= uint64(len(wa) / 4) {
+        return nil
+    }
+    wa = wa[4*int(desk):]
+    return &types.Geometry{int32(wa[0]), int32(wa[1]), int32(wa[2]), int32(wa[3])}
+}
+
+/* Compute again the area available on each screen from the _NET_WORKAREA of
+ * the current desktop and the struts of the docks */
+func (l *Layout) Update(c *xgb.Conn) {
+    scr := xproto.Setup(c).DefaultScreen(c)
+    rw, rh := int32(scr.WidthInPixels), int32(scr.HeightInPixels)
+
+    wa := cardinals(c, scr.Root, l.atoms["_NET_WORKAREA"], xproto.AtomCardinal)
+    desk := uint32(0)
+    if cur := cardinals(c, scr.Root, l.atoms["_NET_CURRENT_DESKTOP"], xproto.AtomCardinal); len(cur) > 0 {
+        desk = cur[0]
+    }
+    work := workArea(wa, desk)
+    sts := l.struts(c, scr.Root, rw, rh)
+
+    l.areas = make([]types.Geometry, len(l.sizes))
+    for i, size := range l.sizes {
+        area := size
+        for _, st := range sts {
+            area = applyStrut(area, st, rw, rh)
+        }
+        /* The work area spans all the screens, so it is only relevant when it
+         * is not reduced to nothing by the intersection */
+        if work != nil {
+            if inter := intersect(area, *work); inter.W > 0 && inter.H > 0 {
+                area = inter
+            }
+        }
+        l.areas[i] = area
+    }
+}
+
+func (l *Layout) Count() uint32 {
+    return l.count
+}
+
+func (l *Layout) Focused(c *xgb.Conn) uint32 {
     incookie := xproto.GetInputFocus(c)
     rep, err := incookie.Reply()
     if err != nil {
@@ -57,7 +256,7 @@ func Focused(c *xgb.Conn) uint32 {
     }
     x,y := int32(att.DstX), int32(att.DstY)
 
-    for i, size := range sizes {
+    for i, size := range l.sizes {
         if size.X <= x && size.X + size.W >= x && size.Y <= y && size.Y + size.H >= y {
             return uint32(i)
         }
@@ -65,10 +264,14 @@ func Focused(c *xgb.Conn) uint32 {
     return 0
 }
 
-func Geom(id uint32) (types.Geometry, error) {
-    if id >= count {
+/* The area of the screen available for the notifications */
+func (l *Layout) Geom(id uint32) (types.Geometry, error) {
+    if id >= l.count {
         return types.Geometry{0, 0, 0, 0}, InvalidIdError(id)
     }
-    return sizes[id], nil
+    if int(id) < len(l.areas) {
+        return l.areas[id], nil
+    }
+    return l.sizes[id], nil
 }
 
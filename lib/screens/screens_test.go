@@ -0,0 +1,42 @@
+package screens
+
+import (
+    "testing"
+    "github.com/BurntSushi/xgb/xproto"
+
+    "github.com/lucas8/notifier/lib/types"
+)
+
+func TestOwnWindow(t *testing.T) {
+    setup := &xproto.SetupInfo{ResourceIdBase: 0x1200000, ResourceIdMask: 0x1fffff}
+    tests := []struct {
+        win  uint32
+        want bool
+    }{
+        {0x1200000, true},
+        {0x1200042, true},
+        {0x13fffff, true},
+        {0x1400001, false},
+        {0x0a00003, false},
+    }
+    for _, test := range tests {
+        if got := ownWindow(setup, test.win); got != test.want {
+            t.Errorf("ownWindow(%#x) is %v, expected %v", test.win, got, test.want)
+        }
+    }
+}
+
+func TestWorkArea(t *testing.T) {
+    wa := []uint32{0, 20, 1920, 1060, 0, 0, 1920, 1040}
+    if work := workArea(wa, 1); work == nil || *work != (types.Geometry{0, 0, 1920, 1040}) {
+        t.Errorf("work area of desktop 1 is %v", work)
+    }
+    for _, desk := range []uint32{2, 0x3fffffff, 0x40000000, 0xffffffff} {
+        if work := workArea(wa, desk); work != nil {
+            t.Errorf("desktop %#x has the work area %v, expected none", desk, *work)
+        }
+    }
+    if work := workArea(wa[:3], 0); work != nil {
+        t.Errorf("a truncated _NET_WORKAREA gives the work area %v", *work)
+    }
+}
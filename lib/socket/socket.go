@@ -0,0 +1,179 @@
+package socket
+
+import (
+    "fmt"
+    "os"
+    "net"
+    "bufio"
+    "strings"
+    "time"
+
+    "github.com/lucas8/notifier/lib/config"
+    "github.com/lucas8/notifier/lib/limit"
+    "github.com/lucas8/notifier/lib/fifo"
+    "github.com/lucas8/notifier/lib/types"
+)
+
+const (
+    defaultName = "xcbnotif.sock"
+    defaultMode = 0600
+)
+
+type NotSocketError string
+func (e NotSocketError) Error() string {
+    return fmt.Sprintf("\"%v\" exists and is not a socket", string(e))
+}
+
+/* The path of the socket : global.socket, or in $XDG_RUNTIME_DIR by default */
+func Path(cfg *config.Tree) string {
+    if path, err := cfg.String("global.socket"); err == nil {
+        return path
+    }
+    dir := os.Getenv("XDG_RUNTIME_DIR")
+    if dir == "" {
+        dir = "/tmp"
+    }
+    return dir + "/" + defaultName
+}
+
+/* A unix socket accepting commands from several clients at once */
+type Socket struct {
+    path string
+    ln   *net.UnixListener
+    parser *fifo.Parser
+    limiter *limit.Limiter
+}
+
+func Open(cfg *config.Tree, parser *fifo.Parser, limiter *limit.Limiter) (*Socket, error) {
+    var sock Socket
+    sock.path = Path(cfg)
+    var mode uint32 = defaultMode
+    if m, err := cfg.Int("global.socket_mode"); err == nil {
+        mode = uint32(m)
+    }
+
+    /* Only remove a socket left by a previous run, never another file */
+    if stat, err := os.Lstat(sock.path); err == nil {
+        if stat.Mode() & os.ModeSocket == 0 {
+            return nil, NotSocketError(sock.path)
+        }
+        err = os.Remove(sock.path)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    ln, err := net.ListenUnix("unix", &net.UnixAddr{sock.path, "unix"})
+    if err != nil {
+        return nil, err
+    }
+    if err := os.Chmod(sock.path, os.FileMode(mode)); err != nil {
+        ln.Close()
+        return nil, err
+    }
+
+    sock.ln      = ln
+    sock.parser  = parser
+    sock.limiter = limiter
+    return &sock, nil
+}
+
+func (sock *Socket) Close() {
+    /* Closing the listener removes the socket file */
+    sock.ln.Close()
+}
+
+/* Accept the clients and send the orders they write to c, until the socket
+ * is closed */
+func (sock *Socket) ReadOrders(c chan<- types.Order) {
+    for {
+        conn, err := sock.ln.AcceptUnix()
+        if err != nil {
+            if ne, ok := err.(net.Error); ok && ne.Temporary() {
+                continue
+            }
+            return
+        }
+        go sock.readClient(conn, c)
+    }
+}
+
+/* How long a client waits for the answer of the queue */
+const replyTimeout = 5 * time.Second
+
+type ReplyTimeoutError struct {}
+func (e ReplyTimeoutError) Error() string {
+    return "no answer from the queue"
+}
+
+func (sock *Socket) readClient(conn *net.UnixConn, c chan<- types.Order) {
+    defer conn.Close()
+    rd := bufio.NewReader(conn)
+    for {
+        line, err := rd.ReadString('\n')
+        /* An incomplete last line is still a command */
+        if line = strings.TrimRight(line, "\n"); line != "" {
+            if fifo.IsJSON(line) {
+                sock.runJSON(conn, line, c)
+            } else if order, ok := sock.parser.Parse(line); ok {
+                order = fifo.WithSource(order, "socket")
+                if sock.limiter.Allow(order) {
+                    c <- order
+                }
+            }
+        }
+        if err != nil {
+            return
+        }
+    }
+}
+
+/* Run a command of the JSON protocol and write the answers to the client */
+func (sock *Socket) runJSON(conn *net.UnixConn, line string, c chan<- types.Order) {
+    order, wait, err := fifo.ParseJSON(line)
+    if err != nil {
+        conn.Write(fifo.Response(nil, err))
+        return
+    }
+
+    order = fifo.WithSource(order, "socket")
+    if !sock.limiter.Allow(order) {
+        conn.Write(fifo.Response(nil, limit.RateLimitedError{}))
+        return
+    }
+    notif, ok := order.(types.NotifOrder)
+    if !ok {
+        c <- order
+        conn.Write(fifo.Response(nil, nil))
+        return
+    }
+
+    reply := make(chan types.Reply, 1)
+    closed := make(chan uint32, 1)
+    clicked := make(chan byte, 1)
+    notif.Reply = reply
+    if wait {
+        notif.Closed = closed
+        notif.Clicked = clicked
+    }
+    c <- notif
+
+    var rep types.Reply
+    select {
+    case rep = <-reply:
+        conn.Write(fifo.Response(&rep.Id, rep.Err))
+    case <-time.After(replyTimeout):
+        conn.Write(fifo.Response(nil, ReplyTimeoutError{}))
+        return
+    }
+
+    /* The client waits until the notification is closed or clicked */
+    if wait && rep.Err == nil {
+        select {
+        case id := <-closed:
+            conn.Write(fifo.ClosedResponse(id))
+        case button := <-clicked:
+            conn.Write(fifo.ClickedResponse(rep.Id, button))
+        }
+    }
+}
@@ -2,7 +2,12 @@ package types
 
 type Order interface {}
 
-type KillOrder struct {}
+/* Close the notifications and stop the queue */
+type KillOrder struct {
+    /* Why the queue stops, nil for a requested stop. When set, the connection
+     * to the X server is gone and the windows are not closed. */
+    Err error
+}
 
 type CloseOrder struct {
     All bool
@@ -14,12 +19,55 @@ type NotifOrder struct {
     Time  uint32
     Level string
     Text  string
+    /* The transport the order came from, "fifo" or "socket" */
+    Source string
+    /* The name of the application which sent it, if it gave one */
+    App string
+    /* The notifications of the same group are shown in one window. It is
+     * the application when empty. */
+    Group string
+    /* The screen to show the notification on, -1 for the focused one */
+    Screen int
+    /* The id of a notification to replace, 0 to open a new one */
+    Replace uint32
+    /* If not nil, receives the id of the notification once opened. It must
+     * be buffered, the queue never waits on it. */
+    Reply chan<- Reply
+    /* If not nil, receives the id of the notification once closed. It must
+     * be buffered too. */
+    Closed chan<- uint32
+    /* If not nil, receives the button each time the notification is clicked.
+     * It must be buffered too, a click is dropped when it is full. */
+    Clicked chan<- byte
+}
+
+/* The answer to an order, for the transports able to reply */
+type Reply struct {
+    Id  uint32
+    Err error
+}
+
+/* Redraw a part of a notification window, or all of them if All is set */
+type RedrawOrder struct {
+    All  bool
+    Win  uint32
+    Area Geometry
+}
+
+/* A notification window was clicked */
+type ClickOrder struct {
+    Win    uint32
+    Button byte
 }
 
-type RedrawOrder struct {}
+/* The area available on the screens changed */
+type WorkareaOrder struct {}
 
 type Geometry struct {
     X, Y int32
     W, H int32
 }
 
+/* Save the visible notifications and stop the queue, so that another instance
+ * can take over */
+type HandoverOrder struct {}
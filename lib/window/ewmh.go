@@ -0,0 +1,97 @@
+package window
+
+import (
+    "os"
+    "github.com/BurntSushi/xgb"
+    "github.com/BurntSushi/xgb/xproto"
+)
+
+const (
+    wmClassInstance = "xcbnotif"
+    wmClassClass    = "Xcbnotif"
+)
+
+var atomNames = [...]string {
+    "UTF8_STRING",
+    "_NET_WM_NAME",
+    "_NET_WM_PID",
+    "_NET_WM_WINDOW_TYPE",
+    "_NET_WM_WINDOW_TYPE_NOTIFICATION",
+    "_NET_WM_STATE",
+    "_NET_WM_STATE_ABOVE",
+    "_NET_WM_STATE_STICKY",
+    "_NET_WM_DESKTOP",
+}
+func (t *Theme) loadAtoms(c *xgb.Conn) error {
+    cookies := make([]xproto.InternAtomCookie, len(atomNames))
+    for i, name := range atomNames {
+        cookies[i] = xproto.InternAtom(c, false, uint16(len(name)), name)
+    }
+
+    t.atoms = make(map[string]xproto.Atom)
+    for i, name := range atomNames {
+        rep, err := cookies[i].Reply()
+        if err != nil {
+            return err
+        }
+        t.atoms[name] = rep.Atom
+    }
+
+    t.overrideRedirect = true
+    if b, err := t.cfg.Bool("global.override_redirect"); err == nil {
+        t.overrideRedirect = b
+    }
+    return nil
+}
+
+func atomsData(list ...xproto.Atom) []byte {
+    data := make([]byte, 4 * len(list))
+    for i, atom := range list {
+        xgb.Put32(data[4*i:], uint32(atom))
+    }
+    return data
+}
+
+func cardinalData(v uint32) []byte {
+    data := make([]byte, 4)
+    xgb.Put32(data, v)
+    return data
+}
+
+/* Set the ICCCM and EWMH properties of a notification window */
+func (t *Theme) setProperties(c *xgb.Conn, win xproto.Window, title string) {
+    /* ICCCM */
+    xproto.ChangeProperty(c, xproto.PropModeReplace, win,
+                          xproto.AtomWmName, xproto.AtomString,
+                          8, uint32(len(title)), []byte(title))
+    class := wmClassInstance + "\x00" + wmClassClass + "\x00"
+    xproto.ChangeProperty(c, xproto.PropModeReplace, win,
+                          xproto.AtomWmClass, xproto.AtomString,
+                          8, uint32(len(class)), []byte(class))
+    /* WM_HINTS : the notifications never take the input focus */
+    hints := make([]byte, 4 * 9)
+    xgb.Put32(hints[0:], 1) /* InputHint */
+    xgb.Put32(hints[4:], 0) /* input = False */
+    xproto.ChangeProperty(c, xproto.PropModeReplace, win,
+                          xproto.AtomWmHints, xproto.AtomWmHints,
+                          32, 9, hints)
+
+    /* EWMH */
+    xproto.ChangeProperty(c, xproto.PropModeReplace, win,
+                          t.atoms["_NET_WM_NAME"], t.atoms["UTF8_STRING"],
+                          8, uint32(len(title)), []byte(title))
+    xproto.ChangeProperty(c, xproto.PropModeReplace, win,
+                          t.atoms["_NET_WM_PID"], xproto.AtomCardinal,
+                          32, 1, cardinalData(uint32(os.Getpid())))
+    xproto.ChangeProperty(c, xproto.PropModeReplace, win,
+                          t.atoms["_NET_WM_WINDOW_TYPE"], xproto.AtomAtom,
+                          32, 1, atomsData(t.atoms["_NET_WM_WINDOW_TYPE_NOTIFICATION"]))
+    xproto.ChangeProperty(c, xproto.PropModeReplace, win,
+                          t.atoms["_NET_WM_STATE"], xproto.AtomAtom,
+                          32, 2, atomsData(t.atoms["_NET_WM_STATE_ABOVE"],
+                                           t.atoms["_NET_WM_STATE_STICKY"]))
+    /* Visible on all desktops */
+    xproto.ChangeProperty(c, xproto.PropModeReplace, win,
+                          t.atoms["_NET_WM_DESKTOP"], xproto.AtomCardinal,
+                          32, 1, cardinalData(0xFFFFFFFF))
+}
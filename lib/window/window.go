@@ -1,12 +1,13 @@
 package window
-/* TODO EWMH support */
-/* TODO ICCCM support */
 
 import (
     "fmt"
     "strings"
+    "unicode/utf8"
     "github.com/BurntSushi/xgb"
     "github.com/BurntSushi/xgb/xproto"
+    "github.com/BurntSushi/xgb/shape"
+    "github.com/BurntSushi/xgb/render"
 
     "github.com/lucas8/notifier/lib/config"
     "github.com/lucas8/notifier/lib/types"
@@ -15,30 +16,64 @@ import (
 const defaultFont = "-*-terminal-medium-r-*-*-14-*-*-*-*-*-iso8859-*"
 
 type color struct {
-    r, g, b uint8
+    r, g, b, a uint8
+}
+
+/* The visual the notifications windows are created with */
+type visualinfo struct {
+    id xproto.Visualid
+    depth byte
+    cmap xproto.Colormap
+    /* A drawable of the visual depth, to create the graphic contexts on */
+    drawable xproto.Drawable
+    /* Set when using a 32 bits ARGB visual, the background is then drawn
+     * using XRender */
+    argb bool
+    format render.Pictformat
 }
 
 type gcontextdata struct {
     fg, bg, bc uint32
+    bgColor color
     width uint32
     border uint32
+    radius uint32
     font uint32
 }
-var defaultgc gcontextdata
 
 type gcontext struct {
     fg, bg, bc xproto.Gcontext
+    bgColor color
     font xproto.Font
     width uint32
     border uint32
+    radius uint32
     fontHeight uint32
     fontUp uint32
 }
-var ctxs map[string]*gcontext
+
+/* The graphic contexts of the levels of a config, for an X connection */
+type Theme struct {
+    cfg *config.Tree
+    vis visualinfo
+    defaultgc gcontextdata
+    ctxs map[string]*gcontext
+    /* Whether the X server supports the Shape extension */
+    hasShape bool
+    atoms map[string]xproto.Atom
+    /* When not set, the windows are left to the window manager, which can
+     * then apply its own rules to them */
+    overrideRedirect bool
+}
 
 type Window struct {
     id xproto.Window
+    /* The rendered notification, copied on the window on expose */
+    pixmap xproto.Pixmap
+    /* The XRender picture of the pixmap, only used with an ARGB visual */
+    picture render.Picture
     conn *xgb.Conn
+    theme *Theme
     lines []string
     gc *gcontext
     geom types.Geometry
@@ -61,7 +96,7 @@ func charValue(c byte) uint8 {
 }
 
 func readColor(str string) color {
-    clr := color{0, 0, 0}
+    clr := color{0, 0, 0, 255}
 
     switch len(str) {
     case 2: /* Format '#G' */
@@ -94,6 +129,17 @@ func readColor(str string) color {
         clr.r = 16 * charValue(str[0]) + charValue(str[1])
         clr.g = 16 * charValue(str[2]) + charValue(str[3])
         clr.b = 16 * charValue(str[4]) + charValue(str[5])
+    case 9: /* Format '#RRGGBBAA' */
+        if str[0] != '#' {
+            break
+        }
+        str = str[1:]
+        fallthrough
+    case 8: /* Format 'RRGGBBAA' */
+        clr.r = 16 * charValue(str[0]) + charValue(str[1])
+        clr.g = 16 * charValue(str[2]) + charValue(str[3])
+        clr.b = 16 * charValue(str[4]) + charValue(str[5])
+        clr.a = 16 * charValue(str[6]) + charValue(str[7])
     }
     return clr
 }
@@ -107,8 +153,26 @@ func openFont(c *xgb.Conn, font string) (xproto.Font, error) {
     return id, err
 }
 
-func openColor(c *xgb.Conn, scr *xproto.ScreenInfo, col color) (uint32, error) {
-    cmap := scr.DefaultColormap
+func premultiply(v, a uint8) uint32 {
+    return uint32(v) * uint32(a) / 255
+}
+
+/* The color as expected by XRender, with premultiplied alpha */
+func renderColor(col color) render.Color {
+    return render.Color{uint16(premultiply(col.r, col.a) * 257),
+                        uint16(premultiply(col.g, col.a) * 257),
+                        uint16(premultiply(col.b, col.a) * 257),
+                        uint16(col.a) * 257}
+}
+
+func (t *Theme) openColor(c *xgb.Conn, scr *xproto.ScreenInfo, col color) (uint32, error) {
+    if t.vis.argb {
+        /* TrueColor 32 bits visual : the pixel is the premultiplied color */
+        return uint32(col.a) << 24 | premultiply(col.r, col.a) << 16 |
+               premultiply(col.g, col.a) << 8 | premultiply(col.b, col.a), nil
+    }
+
+    cmap := t.vis.cmap
     rep, err := xproto.AllocColor(c, cmap,
                 uint16(col.r) * 255, uint16(col.g) * 255, uint16(col.b) * 255).Reply()
     if err != nil {
@@ -117,10 +181,10 @@ func openColor(c *xgb.Conn, scr *xproto.ScreenInfo, col color) (uint32, error) {
     return rep.Pixel, nil
 }
 
-func loadDefaultGC(c *xgb.Conn, scr *xproto.ScreenInfo) error {
+func (t *Theme) loadDefaultGC(c *xgb.Conn, scr *xproto.ScreenInfo) error {
     var font string
-    if config.Has("global.gc.font") {
-        font, _ = config.String("global.gc.font")
+    if t.cfg.Has("global.gc.font") {
+        font, _ = t.cfg.String("global.gc.font")
     } else {
         font = defaultFont
     }
@@ -128,68 +192,76 @@ func loadDefaultGC(c *xgb.Conn, scr *xproto.ScreenInfo) error {
     if err != nil {
         return err
     }
-    defaultgc.font = uint32(fnt)
+    t.defaultgc.font = uint32(fnt)
+
+    if t.cfg.Has("global.width") {
+        wd, _ := t.cfg.Int("global.width")
+        t.defaultgc.width = uint32(wd)
+    } else {
+        t.defaultgc.width = 500
+    }
 
-    if config.Has("global.width") {
-        wd, _ := config.Int("global.width")
-        defaultgc.width = uint32(wd)
+    if t.cfg.Has("global.gc.width") {
+        wd, _ := t.cfg.Int("global.gc.width")
+        t.defaultgc.border = uint32(wd)
     } else {
-        defaultgc.width = 500
+        t.defaultgc.border = 5
     }
 
-    if config.Has("global.gc.width") {
-        wd, _ := config.Int("global.gc.width")
-        defaultgc.border = uint32(wd)
+    if t.cfg.Has("global.gc.radius") {
+        rd, _ := t.cfg.Int("global.gc.radius")
+        t.defaultgc.radius = uint32(rd)
     } else {
-        defaultgc.border = 5
+        t.defaultgc.radius = 0
     }
 
     var cl color
-    if config.Has("global.gc.fg") {
-        str, _ := config.String("global.gc.fg")
+    if t.cfg.Has("global.gc.fg") {
+        str, _ := t.cfg.String("global.gc.fg")
         cl = readColor(str)
     } else {
-        cl = color{255, 255, 255}
+        cl = color{255, 255, 255, 255}
     }
-    defaultgc.fg, err = openColor(c, scr, cl)
+    t.defaultgc.fg, err = t.openColor(c, scr, cl)
     if err != nil {
         return err
     }
 
-    if config.Has("global.gc.bg") {
-        str, _ := config.String("global.gc.bg")
+    if t.cfg.Has("global.gc.bg") {
+        str, _ := t.cfg.String("global.gc.bg")
         cl = readColor(str)
     } else {
-        cl = color{0, 0, 0}
+        cl = color{0, 0, 0, 255}
     }
-    defaultgc.bg, err = openColor(c, scr, cl)
+    t.defaultgc.bgColor = cl
+    t.defaultgc.bg, err = t.openColor(c, scr, cl)
     if err != nil {
         return err
     }
 
-    if config.Has("global.gc.bc") {
-        str, _ := config.String("global.gc.bc")
+    if t.cfg.Has("global.gc.bc") {
+        str, _ := t.cfg.String("global.gc.bc")
         cl = readColor(str)
     } else {
-        cl = color{255, 255, 255}
+        cl = color{255, 255, 255, 255}
     }
-    defaultgc.bc, err = openColor(c, scr, cl)
+    t.defaultgc.bc, err = t.openColor(c, scr, cl)
     if err != nil {
         return err
     }
     return nil
 }
 
-func defaultGCValues(c *xgb.Conn) []uint32 {
+func (t *Theme) defaultGCValues(c *xgb.Conn) []uint32 {
     values := make([]uint32, 4)
-    values[0] = defaultgc.fg
-    values[1] = defaultgc.bg
-    values[2] = defaultgc.border
-    values[3] = defaultgc.font
+    values[0] = t.defaultgc.fg
+    values[1] = t.defaultgc.bg
+    values[2] = t.defaultgc.border
+    values[3] = t.defaultgc.font
     return values
 }
 
-func loadGC(name string, c *xgb.Conn, scr *xproto.ScreenInfo) error {
+func (t *Theme) loadGC(name string, c *xgb.Conn, scr *xproto.ScreenInfo) error {
     var gc gcontext
 
     /* Foreground GC */
@@ -197,29 +269,34 @@ func loadGC(name string, c *xgb.Conn, scr *xproto.ScreenInfo) error {
     if err != nil {
         return err
     }
+    /* This GC is also used to copy the pixmaps, so no GraphicsExposure */
     var mask uint32 = xproto.GcForeground | xproto.GcBackground |
-                      xproto.GcLineWidth  | xproto.GcFont
-    values := defaultGCValues(c)
+                      xproto.GcLineWidth  | xproto.GcFont       |
+                      xproto.GcGraphicsExposures
+    values := t.defaultGCValues(c)
+    values = append(values, 0)
+    gc.bgColor = t.defaultgc.bgColor
     {
-        cl, e := config.String(name + ".gc.fg")
+        cl, e := t.cfg.LevelString(name, "gc.fg")
         if e == nil {
-            values[0], e = openColor(c, scr, readColor(cl))
+            values[0], e = t.openColor(c, scr, readColor(cl))
             if e != nil {
                 return e
             }
         }
-        cl, e = config.String(name + ".gc.bg")
+        cl, e = t.cfg.LevelString(name, "gc.bg")
         if e == nil {
-            values[1], e = openColor(c, scr, readColor(cl))
+            gc.bgColor = readColor(cl)
+            values[1], e = t.openColor(c, scr, gc.bgColor)
             if e != nil {
                 return e
             }
         }
-        wd, e := config.Int(name + ".gc.width")
+        wd, e := t.cfg.LevelInt(name, "gc.width")
         if e == nil {
             values[2] = uint32(wd)
         }
-        cl, e = config.String(name + ".gc.font")
+        cl, e = t.cfg.LevelString(name, "gc.font")
         if e == nil {
             fn, e := openFont(c, cl)
             if e != nil {
@@ -228,7 +305,7 @@ func loadGC(name string, c *xgb.Conn, scr *xproto.ScreenInfo) error {
             values[3] = uint32(fn)
         }
     }
-    err = xproto.CreateGCChecked(c, id, xproto.Drawable(scr.Root), mask, values).Check()
+    err = xproto.CreateGCChecked(c, id, t.vis.drawable, mask, values).Check()
     if err != nil {
         return err
     }
@@ -253,7 +330,7 @@ func loadGC(name string, c *xgb.Conn, scr *xproto.ScreenInfo) error {
     }
     mask = xproto.GcForeground | xproto.GcBackground | xproto.GcLineWidth
     values[0], values[1] = values[1], values[0]
-    err = xproto.CreateGCChecked(c, id, xproto.Drawable(scr.Root), mask, values).Check()
+    err = xproto.CreateGCChecked(c, id, t.vis.drawable, mask, values).Check()
     if err != nil {
         return err
     }
@@ -265,50 +342,142 @@ func loadGC(name string, c *xgb.Conn, scr *xproto.ScreenInfo) error {
         return err
     }
     {
-        cl, e := config.String(name + ".gc.bc")
+        cl, e := t.cfg.LevelString(name, "gc.bc")
         if e == nil {
-            values[0], e = openColor(c, scr, readColor(cl))
+            values[0], e = t.openColor(c, scr, readColor(cl))
             if e != nil {
                 return e
             }
         } else {
-            values[0] = defaultgc.bc
+            values[0] = t.defaultgc.bc
         }
     }
     values[1] = values[0]
-    err = xproto.CreateGCChecked(c, id, xproto.Drawable(scr.Root), mask, values).Check()
+    err = xproto.CreateGCChecked(c, id, t.vis.drawable, mask, values).Check()
     if err != nil {
         return err
     }
     gc.bc = id
 
+    /* Corners radius */
+    {
+        rd, e := t.cfg.LevelInt(name, "gc.radius")
+        if e == nil {
+            gc.radius = uint32(rd)
+        } else {
+            gc.radius = t.defaultgc.radius
+        }
+    }
+
     /* Width */
     {
-        wd, e := config.Int(name + ".width")
+        wd, e := t.cfg.LevelInt(name, "width")
         if e == nil {
             gc.width = uint32(wd)
         } else {
-            gc.width = defaultgc.width
+            gc.width = t.defaultgc.width
         }
     }
 
-    ctxs[name] = &gc
+    t.ctxs[name] = &gc
     return nil
 }
 
-func loadGCS(c *xgb.Conn, scr *xproto.ScreenInfo) error {
-    if !config.Has("global.list") {
+/* Whether a color of the configuration is not fully opaque */
+func (t *Theme) needsAlpha() bool {
+    names := []string{"global"}
+    if list, err := t.cfg.String("global.list"); err == nil {
+        names = append(names, strings.Split(list, ",")...)
+    }
+    for _, name := range names {
+        for _, key := range []string{".gc.fg", ".gc.bg", ".gc.bc"} {
+            if cl, err := t.cfg.String(name + key); err == nil && readColor(cl).a != 255 {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+/* Find a 32 bits visual with an alpha channel */
+func findARGBVisual(c *xgb.Conn) (xproto.Visualid, render.Pictformat, bool) {
+    rep, err := render.QueryPictFormats(c).Reply()
+    if err != nil {
+        return 0, 0, false
+    }
+
+    formats := make(map[render.Pictformat]render.Pictforminfo)
+    for _, info := range rep.Formats {
+        formats[info.Id] = info
+    }
+    for _, scr := range rep.Screens {
+        for _, depth := range scr.Depths {
+            if depth.Depth != 32 {
+                continue
+            }
+            for _, v := range depth.Visuals {
+                info, ok := formats[v.Format]
+                if ok && info.Type == render.PictTypeDirect && info.Direct.AlphaMask != 0 {
+                    return v.Visual, v.Format, true
+                }
+            }
+        }
+    }
+    return 0, 0, false
+}
+
+/* Select the visual of the notifications : the root one, unless a level
+ * requests transparency and the server has an ARGB visual */
+func (t *Theme) loadVisual(c *xgb.Conn, scr *xproto.ScreenInfo) error {
+    t.vis = visualinfo{scr.RootVisual, scr.RootDepth, scr.DefaultColormap,
+                     xproto.Drawable(scr.Root), false, 0}
+    if !t.needsAlpha() || render.Init(c) != nil {
+        return nil
+    }
+
+    id, format, ok := findARGBVisual(c)
+    if !ok {
+        return nil
+    }
+
+    cmap, err := xproto.NewColormapId(c)
+    if err != nil {
+        return err
+    }
+    err = xproto.CreateColormapChecked(c, xproto.ColormapAllocNone, cmap, scr.Root, id).Check()
+    if err != nil {
+        return err
+    }
+
+    pixid, err := xproto.NewPixmapId(c)
+    if err != nil {
+        return err
+    }
+    err = xproto.CreatePixmapChecked(c, 32, pixid, xproto.Drawable(scr.Root), 1, 1).Check()
+    if err != nil {
+        return err
+    }
+
+    t.vis = visualinfo{id, 32, cmap, xproto.Drawable(pixid), true, format}
+    return nil
+}
+
+func (t *Theme) loadGCS(c *xgb.Conn, scr *xproto.ScreenInfo) error {
+    if !t.cfg.Has("global.list") {
         return InvalidConfig("no global.list")
     }
-    err := loadDefaultGC(c, scr)
+    err := t.loadDefaultGC(c, scr)
     if err != nil {
         return err
     }
 
-    list, _ := config.String("global.list")
+    list, _ := t.cfg.String("global.list")
     entries := strings.Split(list, ",")
     for _, entry := range entries {
-        err = loadGC(entry, c, scr)
+        if _, err = t.cfg.Ancestors(entry); err != nil {
+            return err
+        }
+        err = t.loadGC(entry, c, scr)
         if err != nil {
             /* TODO Clean previously loaded gcs */
             return err
@@ -317,23 +486,42 @@ func loadGCS(c *xgb.Conn, scr *xproto.ScreenInfo) error {
     return nil
 }
 
-func Load(c *xgb.Conn) error {
-    ctxs = make(map[string]*gcontext)
+func Load(c *xgb.Conn, cfg *config.Tree) (*Theme, error) {
+    var t Theme
+    t.cfg = cfg
+    t.ctxs = make(map[string]*gcontext)
+    t.hasShape = shape.Init(c) == nil
     scr := xproto.Setup(c).DefaultScreen(c)
-    err := loadGCS(c, scr)
+    err := t.loadAtoms(c)
     if err != nil {
-        return err
+        return nil, err
     }
-    return nil
+    err = t.loadVisual(c, scr)
+    if err != nil {
+        return nil, err
+    }
+    err = t.loadGCS(c, scr)
+    if err != nil {
+        return nil, err
+    }
+    return &t, nil
 }
 
-func Has(name string) bool {
-    _, has := ctxs[name]
+func (t *Theme) Has(name string) bool {
+    _, has := t.ctxs[name]
     return has
 }
 
 func (w *Window) Close() {
     xproto.DestroyWindow(w.conn, w.id)
+    if w.theme.vis.argb {
+        render.FreePicture(w.conn, w.picture)
+    }
+    xproto.FreePixmap(w.conn, w.pixmap)
+}
+
+func (w *Window) Id() uint32 {
+    return uint32(w.id)
 }
 
 func (w *Window) Move(x uint32, y uint32) {
@@ -363,7 +551,35 @@ func prepString(str string) ([]xproto.Char2b, uint16) {
     return ch2b, ln
 }
 
+/* The core fonts are drawn byte by byte : the UTF-8 text is converted to
+ * latin-1, the other characters being replaced by '?'. The bytes which are
+ * not valid UTF-8 are kept, for the clients already sending latin-1. */
+func toLatin1(text string) string {
+    res := make([]byte, 0, len(text))
+    for i := 0; i < len(text); {
+        r, size := utf8.DecodeRuneInString(text[i:])
+        if r == utf8.RuneError && size <= 1 {
+            res = append(res, text[i])
+        } else if r < 0x100 {
+            res = append(res, byte(r))
+        } else {
+            res = append(res, '?')
+        }
+        i += size
+    }
+    return string(res)
+}
+
+/* Cut the text in lines fitting in w, breaking it at the '\n' too */
 func cutLines(c *xgb.Conn, w uint32, font xproto.Font, text string) []string {
+    var lines []string = make([]string, 0, 10)
+    for _, par := range strings.Split(text, "\n") {
+        lines = append(lines, wrapLine(c, w, font, par)...)
+    }
+    return lines
+}
+
+func wrapLine(c *xgb.Conn, w uint32, font xproto.Font, text string) []string {
     wds := strings.Split(text, " ")
     var words []_word = make([]_word, len(wds))
     for i, word := range wds {
@@ -394,13 +610,76 @@ func cutLines(c *xgb.Conn, w uint32, font xproto.Font, text string) []string {
     return lines
 }
 
+/* The four quarter arcs of the corners of a rounded rectangle */
+func roundedCorners(w, h int16, r uint16) []xproto.Arc {
+    d := 2 * int16(r)
+    arcs := make([]xproto.Arc, 4)
+    arcs[0] = xproto.Arc{0,     0,     2*r, 2*r,  90 * 64, 90 * 64}
+    arcs[1] = xproto.Arc{w - d, 0,     2*r, 2*r,   0 * 64, 90 * 64}
+    arcs[2] = xproto.Arc{w - d, h - d, 2*r, 2*r, 270 * 64, 90 * 64}
+    arcs[3] = xproto.Arc{0,     h - d, 2*r, 2*r, 180 * 64, 90 * 64}
+    return arcs
+}
+
+func clampRadius(r uint32, w, h int32) uint16 {
+    if 2*int32(r) > w {
+        r = uint32(w / 2)
+    }
+    if 2*int32(r) > h {
+        r = uint32(h / 2)
+    }
+    return uint16(r)
+}
+
+/* Clip the window to a rounded rectangle using the Shape extension */
+func shapeWindow(c *xgb.Conn, scr *xproto.ScreenInfo, win xproto.Window,
+                 w, h uint16, r uint16) error {
+    pixid, err := xproto.NewPixmapId(c)
+    if err != nil {
+        return err
+    }
+    err = xproto.CreatePixmapChecked(c, 1, pixid, xproto.Drawable(scr.Root), w, h).Check()
+    if err != nil {
+        return err
+    }
+    defer xproto.FreePixmap(c, pixid)
+
+    gcid, err := xproto.NewGcontextId(c)
+    if err != nil {
+        return err
+    }
+    values := make([]uint32, 1)
+    values[0] = 0
+    err = xproto.CreateGCChecked(c, gcid, xproto.Drawable(pixid),
+                                 xproto.GcForeground, values).Check()
+    if err != nil {
+        return err
+    }
+    defer xproto.FreeGC(c, gcid)
+
+    /* Clear the mask then fill the rounded rectangle */
+    rects := make([]xproto.Rectangle, 1)
+    rects[0] = xproto.Rectangle{0, 0, w, h}
+    xproto.PolyFillRectangle(c, xproto.Drawable(pixid), gcid, rects)
+
+    values[0] = 1
+    xproto.ChangeGC(c, gcid, xproto.GcForeground, values)
+    rects = make([]xproto.Rectangle, 2)
+    rects[0] = xproto.Rectangle{int16(r), 0, w - 2*r, h}
+    rects[1] = xproto.Rectangle{0, int16(r), w, h - 2*r}
+    xproto.PolyFillRectangle(c, xproto.Drawable(pixid), gcid, rects)
+    xproto.PolyFillArc(c, xproto.Drawable(pixid), gcid, roundedCorners(int16(w), int16(h), r))
+
+    return shape.MaskChecked(c, shape.SoSet, shape.SkBounding, win, 0, 0, pixid).Check()
+}
+
 type BadContextError string
 func (e BadContextError) Error() string {
     return fmt.Sprintf("Can't open notification with inexistant context : %s", string(e))
 }
 
-func Open(c *xgb.Conn, ctx, title, text string) (*Window, error) {
-    gc, ok := ctxs[ctx]
+func (t *Theme) Open(c *xgb.Conn, ctx, title, text string) (*Window, error) {
+    gc, ok := t.ctxs[ctx]
     if !ok {
         return nil, BadContextError(ctx)
     }
@@ -411,71 +690,161 @@ func Open(c *xgb.Conn, ctx, title, text string) (*Window, error) {
         return nil, err
     }
 
-    lines := cutLines(c, gc.width - 2*gc.border, gc.font, text)
+    lines := cutLines(c, gc.width - 2*gc.border, gc.font, toLatin1(text))
     height := uint32(len(lines)) * gc.fontHeight
 
-    var mask uint32 = xproto.CwBackPixel | xproto.CwOverrideRedirect | xproto.CwEventMask
-    values := make([]uint32, 3)
-    values[0] = scr.WhitePixel
-    values[1] = 1
-    values[2] = xproto.EventMaskExposure
-    err = xproto.CreateWindowChecked(c, xproto.WindowClassCopyFromParent, wdwid, scr.Root,
-                                     0, 0, uint16(gc.width), uint16(height + 2*gc.border), 1,
-                                     xproto.WindowClassInputOutput, scr.RootVisual,
+    /* The background is never painted by the server : the pixmap is copied
+     * on expose, so there is no flicker between clearing and drawing */
+    var mask uint32 = xproto.CwBackPixmap | xproto.CwBorderPixel |
+                      xproto.CwOverrideRedirect | xproto.CwEventMask | xproto.CwColormap
+    values := make([]uint32, 5)
+    values[0] = xproto.BackPixmapNone
+    values[1] = 0
+    if t.overrideRedirect {
+        values[2] = 1
+    } else {
+        values[2] = 0
+    }
+    values[3] = xproto.EventMaskExposure | xproto.EventMaskButtonPress
+    values[4] = uint32(t.vis.cmap)
+    err = xproto.CreateWindowChecked(c, t.vis.depth, wdwid, scr.Root,
+                                     0, 0, uint16(gc.width), uint16(height + 2*gc.border), 0,
+                                     xproto.WindowClassInputOutput, t.vis.id,
                                      mask, values).Check()
     if err != nil {
         return nil, err
     }
-    xproto.ChangeProperty(c, xproto.PropModeReplace, wdwid,
-                          xproto.AtomWmName, xproto.AtomString,
-                          8, uint32(len(title)), []byte(title))
+    t.setProperties(c, wdwid, title)
+
+    radius := clampRadius(gc.radius, int32(gc.width), int32(height + 2*gc.border))
+    if radius > 0 && t.hasShape {
+        err = shapeWindow(c, scr, wdwid, uint16(gc.width), uint16(height + 2*gc.border), radius)
+        if err != nil {
+            xproto.DestroyWindow(c, wdwid)
+            return nil, err
+        }
+    }
+
+    pixid, err := xproto.NewPixmapId(c)
+    if err != nil {
+        xproto.DestroyWindow(c, wdwid)
+        return nil, err
+    }
+    err = xproto.CreatePixmapChecked(c, t.vis.depth, pixid, xproto.Drawable(scr.Root),
+                                     uint16(gc.width), uint16(height + 2*gc.border)).Check()
+    if err != nil {
+        xproto.DestroyWindow(c, wdwid)
+        return nil, err
+    }
+
+    var picid render.Picture
+    if t.vis.argb {
+        picid, err = render.NewPictureId(c)
+        if err == nil {
+            err = render.CreatePictureChecked(c, picid, xproto.Drawable(pixid),
+                                              t.vis.format, 0, nil).Check()
+        }
+        if err != nil {
+            xproto.FreePixmap(c, pixid)
+            xproto.DestroyWindow(c, wdwid)
+            return nil, err
+        }
+    }
 
     var wdw Window
-    wdw.id     = wdwid
-    wdw.conn   = c
-    wdw.lines  = lines
-    wdw.gc     = gc
-    wdw.geom   = types.Geometry{0, 0, int32(gc.width), int32(height + 2*gc.border)}
+    wdw.id      = wdwid
+    wdw.pixmap  = pixid
+    wdw.picture = picid
+    wdw.conn    = c
+    wdw.theme   = t
+    wdw.lines   = lines
+    wdw.gc      = gc
+    wdw.geom    = types.Geometry{0, 0, int32(gc.width), int32(height + 2*gc.border)}
+    wdw.render()
     return &wdw, nil
 }
 
+/* Render another text in the window, and copy it on the screen. Only
+ * possible if the window keeps its level and its size : false is returned
+ * otherwise, and a new window must be opened. */
+func (w *Window) SetText(ctx, text string) bool {
+    gc, ok := w.theme.ctxs[ctx]
+    if !ok || gc != w.gc {
+        return false
+    }
+    lines := cutLines(w.conn, gc.width - 2*gc.border, gc.font, toLatin1(text))
+    if len(lines) != len(w.lines) {
+        return false
+    }
+    w.lines = lines
+    w.render()
+    w.Redraw()
+    return true
+}
+
 func (w* Window) Map() {
     xproto.MapWindow(w.conn, w.id)
 }
 
-func (w *Window) Redraw() {
-    /* Hide X11 borders */
-    var mask uint16 = xproto.ConfigWindowBorderWidth
-    values := make([]uint32, 1)
-    values[0] = 0
-    xproto.ConfigureWindow(w.conn, w.id, mask, values)
+func (w *Window) Unmap() {
+    xproto.UnmapWindow(w.conn, w.id)
+}
 
+/* Draw the notification once into its pixmap */
+func (w *Window) render() {
+    dr := xproto.Drawable(w.pixmap)
     wdt, hgh := int16(w.geom.W), int16(w.geom.H)
     /* Drawing background */
     bg := xproto.Rectangle{0, 0, uint16(wdt), uint16(hgh)}
     bgs := make([]xproto.Rectangle, 1)
     bgs[0] = bg
-    xproto.PolyFillRectangle(w.conn, xproto.Drawable(w.id), w.gc.bg, bgs)
+    if w.theme.vis.argb {
+        render.FillRectangles(w.conn, render.PictOpSrc, w.picture, renderColor(w.gc.bgColor), bgs)
+    } else {
+        xproto.PolyFillRectangle(w.conn, dr, w.gc.bg, bgs)
+    }
 
     /* Drawing borders */
-    vertices := make([]xproto.Point, 5)
-    vertices[0].X = 0;   vertices[0].Y = 0
-    vertices[1].X = wdt; vertices[1].Y = 0
-    vertices[2].X = wdt; vertices[2].Y = hgh
-    vertices[3].X = 0;   vertices[3].Y = hgh
-    vertices[4].X = 0;   vertices[4].Y = 0
-    xproto.PolyLine(w.conn, xproto.CoordModeOrigin, xproto.Drawable(w.id), w.gc.bc, vertices)
+    if r := clampRadius(w.gc.radius, w.geom.W, w.geom.H); r > 0 && w.theme.hasShape {
+        rd := int16(r)
+        segments := make([]xproto.Segment, 4)
+        segments[0] = xproto.Segment{rd,  0,   wdt - rd, 0}
+        segments[1] = xproto.Segment{wdt, rd,  wdt,      hgh - rd}
+        segments[2] = xproto.Segment{rd,  hgh, wdt - rd, hgh}
+        segments[3] = xproto.Segment{0,   rd,  0,        hgh - rd}
+        xproto.PolySegment(w.conn, dr, w.gc.bc, segments)
+        xproto.PolyArc(w.conn, dr, w.gc.bc, roundedCorners(wdt, hgh, r))
+    } else {
+        vertices := make([]xproto.Point, 5)
+        vertices[0].X = 0;   vertices[0].Y = 0
+        vertices[1].X = wdt; vertices[1].Y = 0
+        vertices[2].X = wdt; vertices[2].Y = hgh
+        vertices[3].X = 0;   vertices[3].Y = hgh
+        vertices[4].X = 0;   vertices[4].Y = 0
+        xproto.PolyLine(w.conn, xproto.CoordModeOrigin, dr, w.gc.bc, vertices)
+    }
 
     /* Drawing text */
     hline := int16(w.gc.fontHeight)
     x, y := int16(w.gc.border), int16(w.gc.border + w.gc.fontUp)
     for _, line := range w.lines {
-        xproto.ImageText8(w.conn, byte(len(line)), xproto.Drawable(w.id),
-                          w.gc.fg, x, y, line)
+        xproto.ImageText8(w.conn, byte(len(line)), dr, w.gc.fg, x, y, line)
         y += hline
     }
 }
 
+/* Copy the whole rendered notification on the window */
+func (w *Window) Redraw() {
+    w.RedrawArea(types.Geometry{0, 0, w.geom.W, w.geom.H})
+}
+
+/* Copy only the area of the rendered notification, in window coordinates */
+func (w *Window) RedrawArea(area types.Geometry) {
+    xproto.CopyArea(w.conn, xproto.Drawable(w.pixmap), xproto.Drawable(w.id), w.gc.fg,
+                    int16(area.X), int16(area.Y), int16(area.X), int16(area.Y),
+                    uint16(area.W), uint16(area.H))
+}
+
 func (w *Window) Geom() types.Geometry {
     return w.geom
 }
@@ -1,9 +1,13 @@
 package main
 
 import (
+    "os"
     "fmt"
+    "flag"
     "strings"
     "strconv"
+    "syscall"
+    "os/signal"
     "github.com/BurntSushi/xgb"
     "github.com/BurntSushi/xgb/xproto"
 
@@ -11,7 +15,10 @@ import (
     "github.com/lucas8/notifier/lib/screens"
     "github.com/lucas8/notifier/lib/window"
     "github.com/lucas8/notifier/lib/fifo"
+    "github.com/lucas8/notifier/lib/socket"
     "github.com/lucas8/notifier/lib/queue"
+    "github.com/lucas8/notifier/lib/lock"
+    "github.com/lucas8/notifier/lib/limit"
     "github.com/lucas8/notifier/lib/types"
 )
 
@@ -20,7 +27,7 @@ func (c *KillCommand) Validate(str string) bool {
     return str == "kill" || str == "end"
 }
 func (c *KillCommand) Get() types.Order {
-    return types.KillOrder {}
+    return types.KillOrder {nil}
 }
 
 type RedrawCommand struct {}
@@ -28,7 +35,7 @@ func (c *RedrawCommand) Validate(str string) bool {
     return str == "redraw"
 }
 func (c *RedrawCommand) Get() types.Order {
-    return types.RedrawOrder {}
+    return types.RedrawOrder {true, 0, types.Geometry{}}
 }
 
 type CloseCommand types.CloseOrder
@@ -67,83 +74,209 @@ func (c *NotifCommand) Get() types.Order {
     return types.NotifOrder(*c)
 }
 
+var checkConfig = flag.Bool("check-config", false,
+                            "parse and validate the config file, then exit")
+var dumpConfig  = flag.Bool("dump-config", false,
+                            "print the effective config with the defaults resolved, then exit")
+var replace     = flag.Bool("replace", false,
+                            "take over the notifications of the running instance and replace it")
+
+/* Check the config without connecting to the X server. Exits with a non-zero
+ * status if it is invalid. */
+func configMode(cfg *config.Tree) {
+    if err := cfg.Validate(); err != nil {
+        fmt.Fprintf(os.Stderr, "%v\n", err)
+        os.Exit(1)
+    }
+    if *dumpConfig {
+        cfg.Dump(os.Stdout)
+    }
+    os.Exit(0)
+}
+
 func main() {
+    os.Exit(run())
+}
+
+/* Run the daemon, returns the exit status once it has cleaned up */
+func run() int {
     /* Loading config */
-    if err := config.Load(config.ConfigPath()); err != nil {
+    var cfg *config.Tree
+    if t, err := config.Load(config.ConfigPath()); err != nil {
+        if *checkConfig || *dumpConfig {
+            fmt.Fprintf(os.Stderr, "%v\n", err)
+            os.Exit(1)
+        }
         fmt.Printf("Error when loading config : %v\n", err)
-        return
+        return 1
+    } else {
+        cfg = t
+    }
+    if *checkConfig || *dumpConfig {
+        configMode(cfg)
+    }
+    if err := cfg.Validate(); err != nil {
+        fmt.Printf("Warnings in config :\n%v\n", err)
     }
 
+    /* Only one instance may own the fifo and the notifications */
+    var lck *lock.Lock
+    if l, err := lock.Acquire(*replace); err != nil {
+        fmt.Fprintf(os.Stderr, "%v\n", err)
+        return 1
+    } else {
+        lck = l
+    }
+    defer lck.Release()
+
     /* Opening the connection */
     var conn *xgb.Conn
     if c, err := xgb.NewConn(); err != nil {
         fmt.Printf("Error when connecting to x11 server : %v\n", err)
-        return
+        return 1
     } else {
         conn = c
     }
-    defer conn.Close()
+    /* A lost connection has already been closed by xgb */
+    lost := false
+    defer func() {
+        if !lost {
+            conn.Close()
+        }
+    }()
 
     /* Loading screens configuration */
-    if err := screens.Load(conn); err != nil {
+    var layout *screens.Layout
+    if l, err := screens.Load(conn); err != nil {
         fmt.Printf("Error while getting screens configuration : %v\n", err)
-        return
+        return 1
+    } else {
+        layout = l
     }
 
     /* Loading window manager */
-    if err := window.Load(conn); err != nil {
+    var theme *window.Theme
+    if t, err := window.Load(conn, cfg); err != nil {
         fmt.Printf("Error while loading window manager : %v\n", err)
-        return
-    }
-
-    /* Opening the fifo */
-    var pipe *fifo.Fifo
-    if p, err := fifo.Open(); err != nil {
-        fmt.Printf("Error while opening the fifo : %s\n", err)
-        return
+        return 1
     } else {
-        pipe = p
+        theme = t
     }
-    defer pipe.Close()
+
+    /* Opening the transports. The orders of the clients are limited, those of
+     * the X server and of the signals have their own channel so that a flood
+     * of notifications never blocks them. */
+    orders := make(chan types.Order, 10)
+    events := make(chan types.Order, 10)
+    limiter := limit.New(cfg, orders)
+    parser := fifo.NewParser()
     cmds := [...]fifo.Command {
         &KillCommand {},
         &RedrawCommand {},
         &CloseCommand {false, false, 0},
-        &NotifCommand {0, "", ""},
+        &NotifCommand {Screen: -1},
     }
     for _, cmd := range cmds {
-        pipe.AddCmd(cmd)
+        parser.AddCmd(cmd)
+    }
+
+    transport := "both"
+    if tr, err := cfg.String("global.transport"); err == nil {
+        transport = tr
+    }
+
+    var pipe *fifo.Fifo
+    if transport == "fifo" || transport == "both" {
+        if p, err := fifo.Open(cfg, parser, limiter); err != nil {
+            fmt.Printf("Error while opening the fifo : %s\n", err)
+            return 1
+        } else {
+            pipe = p
+        }
+        defer pipe.Close()
+    }
+
+    var sock *socket.Socket
+    if transport == "socket" || transport == "both" {
+        if s, err := socket.Open(cfg, parser, limiter); err != nil {
+            fmt.Printf("Error while opening the socket : %s\n", err)
+            return 1
+        } else {
+            sock = s
+        }
+        defer sock.Close()
     }
 
     /* Opening the queue */
     var notifs *queue.Queue
-    if q, err := queue.Open(conn); err != nil {
+    if q, err := queue.Open(conn, cfg, layout, theme); err != nil {
         fmt.Printf("Error while opening the queue : %s\n", err)
-        return
+        return 1
     } else {
         notifs = q
     }
+    if err := notifs.Restore(); err != nil {
+        fmt.Printf("Error while restoring the notifications : %s\n", err)
+    }
 
     /* Main loop */
-    orders := make(chan types.Order, 10)
-    go xloop(conn, orders)
-    go pipe.ReadOrders(orders)
-    notifs.Run(orders)
+    go signals(events)
+    go xloop(conn, layout, events)
+    if pipe != nil {
+        go pipe.ReadOrders(orders)
+    }
+    if sock != nil {
+        go sock.ReadOrders(orders)
+    }
+    if err := notifs.Run(orders, events); err != nil {
+        _, lost = err.(ConnectionLostError)
+        fmt.Printf("Stopping : %s\n", err)
+        return 1
+    }
+    return 0
+}
+
+/* A new instance started with --replace sends SIGUSR1 to take over, and
+ * SIGTERM or SIGINT stop the daemon after closing the notifications */
+func signals(c chan types.Order) {
+    sigs := make(chan os.Signal, 1)
+    signal.Notify(sigs, syscall.SIGUSR1, syscall.SIGTERM, syscall.SIGINT)
+    for sig := range sigs {
+        if sig == syscall.SIGUSR1 {
+            c <- types.HandoverOrder {}
+        } else {
+            /* A second signal kills the daemon if the shutdown hangs */
+            signal.Reset(syscall.SIGTERM, syscall.SIGINT)
+            c <- types.KillOrder {nil}
+        }
+    }
 }
 
-func xloop(conn *xgb.Conn, c chan types.Order) {
+type ConnectionLostError struct {}
+func (e ConnectionLostError) Error() string {
+    return "lost the connection to the x11 server"
+}
+
+func xloop(conn *xgb.Conn, layout *screens.Layout, c chan types.Order) {
     for {
         ev, xerr := conn.WaitForEvent()
         if ev == nil && xerr == nil {
-            c <- types.KillOrder {}
+            c <- types.KillOrder {ConnectionLostError{}}
+            return
         }
 
         if ev != nil {
-            switch ev.(type) {
+            switch e := ev.(type) {
             case xproto.ExposeEvent:
-                c <- types.RedrawOrder {}
+                area := types.Geometry{int32(e.X), int32(e.Y), int32(e.Width), int32(e.Height)}
+                c <- types.RedrawOrder {false, uint32(e.Window), area}
+            case xproto.ButtonPressEvent:
+                c <- types.ClickOrder {uint32(e.Event), byte(e.Detail)}
+            case xproto.PropertyNotifyEvent:
+                if layout.Watched(e.Atom) {
+                    c <- types.WorkareaOrder {}
+                }
             }
         }
     }
 }
-